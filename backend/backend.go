@@ -24,11 +24,22 @@ type Backend interface {
 	GetPath() string
 }
 
+// Cloner is implemented by backends with a cheaper way than copying to
+// populate a root from a pristine one, e.g. a btrfs snapshot
+type Cloner interface {
+	// MakeRoot creates the empty directory of a pristine root
+	MakeRoot(path string) error
+	// Clone populates the root dst from the pristine root src
+	Clone(src, dst string) error
+}
+
 // GetBackend - get a backend with string name
 func GetBackend(name string) BackendFilesystem {
 	switch name {
 	case "overlay":
 		return Overlay
+	case "btrfs":
+		return Btrfs
 	// case "rsync":
 	// 	return &rsync.Rsync{}, nil
 	default:
@@ -0,0 +1,71 @@
+package fake
+
+import (
+	"path"
+)
+
+// Backend is an in-memory backend.Backend which records the snapshot
+// lifecycle without touching the filesystem.
+type Backend struct {
+	RootPath    string
+	CurrentPath string
+	Snapshots   map[string]string
+
+	// Events in the order they happened, e.g. "setup", "add build",
+	// "remove build" and "destroy"
+	Events []string
+
+	// Errors returned by the method of the same name, if set
+	Errors map[string]error
+}
+
+func (b *Backend) Setup() (string, error) {
+	b.Events = append(b.Events, "setup")
+	if err := b.Errors["Setup"]; err != nil {
+		return "", err
+	}
+	return b.RootPath, nil
+}
+
+func (b *Backend) AddSnapshot(name string) (string, error) {
+	b.Events = append(b.Events, "add "+name)
+	if err := b.Errors["AddSnapshot"]; err != nil {
+		return "", err
+	}
+	directory, _ := path.Split(b.RootPath)
+	b.Snapshots[name] = path.Join(directory, name)
+	b.CurrentPath = b.Snapshots[name]
+	return b.Snapshots[name], nil
+}
+
+func (b *Backend) RemoveSnapshot(name string) error {
+	b.Events = append(b.Events, "remove "+name)
+	if err := b.Errors["RemoveSnapshot"]; err != nil {
+		return err
+	}
+	delete(b.Snapshots, name)
+	b.CurrentPath = b.RootPath
+	return nil
+}
+
+func (b *Backend) Destroy() error {
+	b.Events = append(b.Events, "destroy")
+	if err := b.Errors["Destroy"]; err != nil {
+		return err
+	}
+	b.Snapshots = make(map[string]string)
+	return nil
+}
+
+func (b *Backend) GetPath() string {
+	return b.CurrentPath
+}
+
+func NewBackend(path string) *Backend {
+	return &Backend{
+		RootPath:    path,
+		CurrentPath: path,
+		Snapshots:   make(map[string]string),
+		Errors:      make(map[string]error),
+	}
+}
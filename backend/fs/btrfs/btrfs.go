@@ -1 +1,172 @@
 package btrfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/foxboron/devtools/backend"
+	"github.com/foxboron/devtools/utils"
+)
+
+// Inode number of the top directory of every btrfs subvolume
+const subvolumeInode = 256
+
+// Btrfs keeps the root in a subvolume and snapshots it for builds
+type Btrfs struct {
+	RootPath    string
+	CurrentPath string
+	Snapshots   map[string]string
+}
+
+func btrfs(args ...string) error {
+	out, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("btrfs %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// isSubvolume reports if dir is the top of a btrfs subvolume
+func isSubvolume(dir string) bool {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil || fs.Type != unix.BTRFS_SUPER_MAGIC {
+		return false
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return false
+	}
+	return st.Ino == subvolumeInode
+}
+
+// sameFilesystem reports if a and b can be snapshotted into each other
+func sameFilesystem(a, b string) bool {
+	var fsA, fsB unix.Statfs_t
+	if unix.Statfs(a, &fsA) != nil || unix.Statfs(b, &fsB) != nil {
+		return false
+	}
+	return fsA.Fsid == fsB.Fsid
+}
+
+// onBtrfs reports if a new directory in dir would be on btrfs
+func onBtrfs(dir string) bool {
+	var fs unix.Statfs_t
+	return unix.Statfs(dir, &fs) == nil && fs.Type == unix.BTRFS_SUPER_MAGIC
+}
+
+// removeSubvolume deletes dir, a subvolume or a plain directory
+func removeSubvolume(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	if isSubvolume(dir) {
+		return btrfs("subvolume", "delete", dir)
+	}
+	return os.RemoveAll(dir)
+}
+
+func (b *Btrfs) Setup() (string, error) {
+	if _, err := os.Stat(b.RootPath); os.IsNotExist(err) {
+		if err := b.MakeRoot(b.RootPath); err != nil {
+			return "", fmt.Errorf("Failed to setup btrfs backend: %s", err)
+		}
+	}
+	fileInfo := path.Join(b.RootPath, ".arch-chroot-fs")
+	if err := ioutil.WriteFile(fileInfo, []byte("btrfs"), 0644); err != nil {
+		return "", fmt.Errorf("Failed to write filesystem file")
+	}
+	return b.RootPath, nil
+}
+
+func (b *Btrfs) AddSnapshot(name string) (string, error) {
+	directory, _ := path.Split(b.RootPath)
+	snapshot := path.Join(directory, name)
+	if err := removeSubvolume(snapshot); err != nil {
+		return "", err
+	}
+	if err := btrfs("subvolume", "snapshot", b.RootPath, snapshot); err != nil {
+		return "", fmt.Errorf("Failed to snapshot %s: %s", b.RootPath, err)
+	}
+	b.Snapshots[name] = snapshot
+	b.CurrentPath = snapshot
+	return snapshot, nil
+}
+
+func (b *Btrfs) RemoveSnapshot(name string) error {
+	snapshot, ok := b.Snapshots[name]
+	if !ok {
+		directory, _ := path.Split(b.RootPath)
+		snapshot = path.Join(directory, name)
+	}
+	if err := removeSubvolume(snapshot); err != nil {
+		return fmt.Errorf("Failed to remove snapshot %s: %s", name, err)
+	}
+	delete(b.Snapshots, name)
+	b.CurrentPath = b.RootPath
+	return nil
+}
+
+func (b *Btrfs) Destroy() error {
+	for name := range b.Snapshots {
+		if err := b.RemoveSnapshot(name); err != nil {
+			return err
+		}
+	}
+	if err := removeSubvolume(b.RootPath); err != nil {
+		return fmt.Errorf("Failed to cleanup btrfs: %s", err)
+	}
+	return nil
+}
+
+func (b *Btrfs) GetPath() string {
+	return b.CurrentPath
+}
+
+// MakeRoot creates a subvolume on btrfs and a plain directory elsewhere
+func (b *Btrfs) MakeRoot(dir string) error {
+	if err := os.MkdirAll(path.Dir(dir), 0755); err != nil {
+		return err
+	}
+	if !onBtrfs(path.Dir(dir)) {
+		return os.Mkdir(dir, 0755)
+	}
+	return btrfs("subvolume", "create", dir)
+}
+
+// Clone replaces dst with a snapshot of src if both are subvolumes of the
+// same filesystem and copies src into dst otherwise
+func (b *Btrfs) Clone(src, dst string) error {
+	if !isSubvolume(src) || !isSubvolume(dst) || !sameFilesystem(src, dst) {
+		return utils.CloneTree(src, dst)
+	}
+	// The marker of the backend is all Setup put into dst
+	fileInfo := path.Join(dst, ".arch-chroot-fs")
+	marker, err := ioutil.ReadFile(fileInfo)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := btrfs("subvolume", "delete", dst); err != nil {
+		return err
+	}
+	if err := btrfs("subvolume", "snapshot", src, dst); err != nil {
+		return err
+	}
+	if marker != nil {
+		return ioutil.WriteFile(fileInfo, marker, 0644)
+	}
+	return nil
+}
+
+func NewBtrfs(path string) backend.Backend {
+	return &Btrfs{
+		RootPath:    path,
+		CurrentPath: path,
+		Snapshots:   make(map[string]string),
+	}
+}
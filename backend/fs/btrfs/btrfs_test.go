@@ -0,0 +1,48 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCloneFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if onBtrfs(dir) {
+		t.Skip("Needs a temporary directory outside of btrfs")
+	}
+
+	b := NewBtrfs(path.Join(dir, "root")).(*Btrfs)
+	src := path.Join(dir, "pristine")
+	if err := b.MakeRoot(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(src, "file"), []byte("pristine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := b.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Clone(src, root); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path.Join(root, "file"))
+	if err != nil || string(buf) != "pristine" {
+		t.Errorf("root was not populated: %q, %v", buf, err)
+	}
+	if _, err := os.Stat(path.Join(root, ".arch-chroot-fs")); err != nil {
+		t.Error("backend marker is gone")
+	}
+	if err := b.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Error("root was not removed")
+	}
+}
@@ -2,29 +2,86 @@ package archiso
 
 import (
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
-	"time"
 
-	alpm "github.com/Jguer/go-alpm"
-	"github.com/foxboron/devtools/bootstrap"
+	"github.com/foxboron/devtools/backend"
 	"github.com/foxboron/devtools/utils"
 )
 
 var (
 	PacmanConf  string = "/etc/pacman.conf"
 	IsoCacheDir        = "/var/cache/devtools"
+
+	// The Arch Linux mirrors only publish bootstrap tarballs for x86_64
+	officialArchitecture = "x86_64"
+
+	// Root filesystems for architectures not published on the Arch Linux
+	// mirrors
+	foreignRootfs = map[string]rootfs{
+		"aarch64": {"http://os.archlinuxarm.org/os/", "ArchLinuxARM-aarch64-latest.tar.gz", ArchlinuxARMKeyring},
+		"armv7h":  {"http://os.archlinuxarm.org/os/", "ArchLinuxARM-armv7-latest.tar.gz", ArchlinuxARMKeyring},
+		"riscv64": {"https://archriscv.felixc.at/images/", "archriscv-latest.tar.zst", ArchRISCVKeyring},
+	}
 )
 
-type Archiso struct {
+// Keyrings of the ports, their tarballs are not signed by Arch Linux keys
+const (
+	ArchlinuxARMKeyring = "/usr/share/pacman/keyrings/archlinuxarm.gpg"
+	ArchRISCVKeyring    = "/usr/share/pacman/keyrings/archriscv.gpg"
+)
+
+// rootfs is where the tarball of a foreign architecture comes from and the
+// keyring it is signed with
+type rootfs struct {
 	Mirror  string
-	ISOName string
-	Path    string
+	Tarball string
+	Keyring string
+}
+
+type Archiso struct {
+	Mirror       string
+	ISOName      string
+	Path         string
+	Architecture string
+
+	// IsoURLs are the iso/ directories of the mirrors, tried in order. The
+	// release is resolved from them when Mirror and ISOName are unset.
+	IsoURLs []string
+	// Version pins the release, e.g. 2020.01.01. The newest release is used
+	// if empty.
+	Version string
+
+	// Keyring the signature of the tarball is verified against, the one of
+	// the source of the tarball if empty
+	Keyring string
+
+	// Leading path components removed when extracting, the official
+	// tarballs keep the root in root.$arch/
+	StripComponents int
+
+	// Checksum files published next to the tarball, see utils.ChecksumFiles.
+	// The Arch Linux ARM and RISC-V images only carry a signature.
+	ChecksumFiles []string
+
+	// Refresh is set for tarballs replaced upstream under the same name,
+	// like ArchLinuxARM-aarch64-latest.tar.gz. The cached tarball is
+	// downloaded again once the mirror serves a different one.
+	Refresh bool
 
 	// This is where we store the ISO
 	TmpPath string
+
+	// Cloner of the backend populates roots from the pristine root, they
+	// are copied without one
+	Cloner backend.Cloner
+}
+
+// SetCloner implements bootstrap.Cached
+func (a *Archiso) SetCloner(cloner backend.Cloner) {
+	a.Cloner = cloner
 }
 
 func (a *Archiso) DownloadISO() (string, error) {
@@ -35,64 +92,258 @@ func (a *Archiso) DownloadISO() (string, error) {
 		}
 		a.TmpPath = IsoCacheDir
 	}
+	if a.ISOName == "" {
+		if err := a.resolve(); err != nil {
+			return "", err
+		}
+	}
 	isoPath := path.Join(a.TmpPath, a.ISOName)
-	if _, err := os.Stat(isoPath); os.IsNotExist(err) {
-		utils.Msg2f("Downloading %s...", a.ISOName)
-		utils.DownloadFile(isoPath, a.Mirror+a.ISOName)
-		utils.DownloadFile(isoPath+".sig", a.Mirror+a.ISOName+".sig")
-		err := utils.VerifySignature(path.Join(a.TmpPath, a.ISOName), path.Join(a.TmpPath, a.ISOName+".sig"))
-		if err != nil {
-			return "", fmt.Errorf("signature check failed")
+	var validator string
+	if a.Refresh {
+		validator = a.refresh(isoPath)
+	}
+	if _, err := os.Stat(isoPath); err == nil {
+		err := a.Verify(isoPath)
+		if err == nil {
+			return isoPath, nil
+		}
+		utils.Warningf("%s, downloading it again", err)
+	}
+	// A tarball which fails verification may be corrupt on the mirror it
+	// came from, try the next one
+	mirrors := len(a.urls(""))
+	var err error
+	for first := 0; first < mirrors; first++ {
+		if first > 0 {
+			utils.Warningf("%s, trying the next mirror", err)
+		}
+		// Checksums are fetched again along with the tarball
+		a.removeDownload(isoPath)
+		if err = a.download(isoPath, first); err != nil {
+			return "", err
+		}
+		if err = a.verify(isoPath, first); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		a.removeDownload(isoPath)
+		return "", err
+	}
+	if validator != "" {
+		if err := ioutil.WriteFile(isoPath+".validator", []byte(validator), 0644); err != nil {
+			return "", err
 		}
 	}
 	return isoPath, nil
 }
 
-func (a *Archiso) Init(dst string) error {
-	isoPath, err := a.DownloadISO()
+// download fetches the tarball and its signature, from the mirror at index
+// first of urls and the ones after it
+func (a *Archiso) download(isoPath string, first int) error {
+	utils.Msg2f("Downloading %s...", a.ISOName)
+	progress := utils.NewProgress(a.ISOName, -1)
+	tarball := utils.NewDownload(isoPath, a.mirrorURLs(a.ISOName, first)...)
+	tarball.Progress = progress.Set
+	downloads := []*utils.Download{
+		tarball,
+		utils.NewDownload(isoPath+".sig", a.mirrorURLs(a.ISOName+".sig", first)...),
+	}
+	err := utils.DownloadAll(downloads, utils.DownloadParallel)
+	progress.Done()
+	return err
+}
+
+// removeDownload removes the tarball along with its signature and checksums
+func (a *Archiso) removeDownload(isoPath string) {
+	os.Remove(isoPath)
+	os.Remove(isoPath + ".sig")
+	for _, name := range a.ChecksumFiles {
+		os.Remove(isoPath + "." + name)
+	}
+}
+
+// refresh removes the cached tarball if the mirror serves a different one
+// than the cached validator names and returns the validator of the mirror.
+// The cached tarball is kept if the mirror can't be reached.
+func (a *Archiso) refresh(isoPath string) string {
+	validator, err := utils.Validator(a.Mirror + a.ISOName)
 	if err != nil {
-		return err
+		utils.Warningf("Could not check %s for updates: %s", a.ISOName, err)
+		return ""
+	}
+	if validator == "" {
+		return ""
+	}
+	cached, err := ioutil.ReadFile(isoPath + ".validator")
+	if err == nil && string(cached) == validator {
+		return validator
+	}
+	if _, err := os.Stat(isoPath); err == nil {
+		utils.Msg2f("%s was updated upstream", a.ISOName)
 	}
-	if _, err := os.Stat(path.Join(dst, ".arch-chroot")); os.IsNotExist(err) {
-		err = utils.Untar(isoPath, dst)
+	for _, filename := range []string{isoPath, isoPath + ".sig", isoPath + ".validator"} {
+		os.Remove(filename)
+	}
+	return validator
+}
+
+// Verify checks the tarball against the checksums published next to it and
+// its signature. The checksum files are cached alongside the tarball.
+func (a *Archiso) Verify(isoPath string) error {
+	return a.verify(isoPath, 0)
+}
+
+// verify is Verify fetching missing checksum files from the mirror at index
+// first of urls and the ones after it
+func (a *Archiso) verify(isoPath string, first int) error {
+	for _, name := range a.ChecksumFiles {
+		sumsPath := isoPath + "." + name
+		if _, err := os.Stat(sumsPath); os.IsNotExist(err) {
+			if err := utils.NewDownload(sumsPath, a.mirrorURLs(name, first)...).Run(); err != nil {
+				return err
+			}
+		}
+		sums, err := utils.ParseChecksums(sumsPath)
 		if err != nil {
-			return fmt.Errorf("Could not untar ISO: %s", err)
+			return err
+		}
+		expected, ok := sums[a.ISOName]
+		if !ok {
+			return fmt.Errorf("%s is not listed in %s", a.ISOName, name)
+		}
+		if err := utils.VerifyChecksum(isoPath, expected, utils.ChecksumFiles[name]); err != nil {
+			return err
 		}
 	}
+	fingerprint, err := utils.VerifySignatureOpenPGP(isoPath, isoPath+".sig", a.keyring())
+	if err != nil {
+		return err
+	}
+	utils.Msg2f("Signed by %s", fingerprint)
 	return nil
 }
 
-func GetArchIsoName() string {
-	name := "archlinux-bootstrap-%s.01-%s.tar.gz"
-	t := time.Now()
-	return fmt.Sprintf(name, t.Format("2006.01"), "x86_64")
+// urls returns where a file next to the tarball is found, on the mirror the
+// release was resolved from first and then on the other mirrors
+func (a *Archiso) urls(name string) []string {
+	urls := []string{a.Mirror + name}
+	for _, isoURL := range a.IsoURLs {
+		if !strings.HasPrefix(a.Mirror, isoURL) {
+			continue
+		}
+		release := strings.TrimPrefix(a.Mirror, isoURL)
+		for _, other := range a.IsoURLs {
+			if other != isoURL {
+				urls = append(urls, other+release+name)
+			}
+		}
+		break
+	}
+	return urls
 }
 
-func NewArchiso(PacmanConf string) bootstrap.Bootstrap {
-	b, err := os.Open(PacmanConf)
+// mirrorURLs returns urls starting at the mirror at index first
+func (a *Archiso) mirrorURLs(name string, first int) []string {
+	urls := a.urls(name)
+	return append(urls[first:], urls[:first]...)
+}
+
+// resolve picks the release to download from the first mirror which can be
+// reached, falling back to the newest tarball in the cache
+func (a *Archiso) resolve() error {
+	if a.Architecture != officialArchitecture {
+		return fmt.Errorf("No bootstrap tarball is published for %s, use the pacstrap bootstrap with a pacman.conf for it instead", a.Architecture)
+	}
+	err := fmt.Errorf("No mirror configured for core")
+	for _, isoURL := range a.IsoURLs {
+		if a.Version != "" {
+			a.Mirror, a.ISOName, err = PinnedRelease(isoURL, a.TmpPath, a.Version, a.Architecture)
+		} else {
+			a.Mirror, a.ISOName, err = ResolveRelease(isoURL, a.Architecture)
+		}
+		if err == nil {
+			return nil
+		}
+		utils.Warningf("%s", err)
+	}
+	if a.Version != "" {
+		return err
+	}
+	name, ok := CachedRelease(a.TmpPath, a.Architecture)
+	if !ok {
+		return err
+	}
+	utils.Warningf("Using cached %s", name)
+	a.ISOName = name
+	if len(a.IsoURLs) != 0 {
+		a.Mirror = a.IsoURLs[0] + "latest/"
+	}
+	return nil
+}
+
+func (a *Archiso) keyring() string {
+	if a.Keyring != "" {
+		return a.Keyring
+	}
+	if rootfs, ok := foreignRootfs[a.Architecture]; ok {
+		return rootfs.Keyring
+	}
+	return utils.ArchlinuxKeyring
+}
+
+func (a *Archiso) Init(dst string) error {
+	isoPath, err := a.DownloadISO()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path.Join(dst, ".arch-chroot")); !os.IsNotExist(err) {
+		return nil
+	}
+	pristine, lock, err := a.Pristine(isoPath)
 	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	utils.Msg2f("Populating %s from %s", dst, pristine)
+	if a.Cloner != nil {
+		return a.Cloner.Clone(pristine, dst)
 	}
+	return utils.CloneTree(pristine, dst)
+}
 
-	pacmanconf, err := alpm.ParseConfig(b)
+func NewArchiso(PacmanConf, Architecture string) (*Archiso, error) {
+	if Architecture == "" {
+		Architecture = utils.HostArchitecture()
+	}
+	if rootfs, ok := foreignRootfs[Architecture]; ok {
+		return &Archiso{
+			Mirror:       rootfs.Mirror,
+			ISOName:      rootfs.Tarball,
+			Architecture: Architecture,
+			Refresh:      true,
+		}, nil
+	}
+
+	pacmanconf, err := utils.GetPacmanConf(PacmanConf)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// Get the first mirror to core
-	var mirror string
-	for _, v := range pacmanconf.Repos {
-		if v.Name != "core" {
-			continue
-		}
-		s := strings.Split(v.Servers[0], "$repo")
-		mirror = s[0]
-		break
+	var isoURLs []string
+	for _, mirror := range utils.Mirrors(pacmanconf, "core") {
+		isoURLs = append(isoURLs, mirror+"iso/")
 	}
 
 	return &Archiso{
-		Mirror:  mirror + "iso/latest/",
-		ISOName: GetArchIsoName(),
-		TmpPath: "",
-		Path:    "",
-	}
+		IsoURLs:         isoURLs,
+		TmpPath:         "",
+		Path:            "",
+		Architecture:    Architecture,
+		StripComponents: 1,
+		ChecksumFiles: []string{
+			"sha256sums.txt",
+			"b2sums.txt",
+		},
+	}, nil
 }
@@ -1,15 +1,30 @@
 package archiso
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
 	"testing"
+
+	openpgp "golang.org/x/crypto/openpgp"
 )
 
 func TestArchiso(t *testing.T) {
 	// fmt.Println()
 
+	archiso, err := NewArchiso(PacmanConf, "")
+	if err != nil {
+		t.Skipf("Needs the pacman.conf of an Arch Linux host: %s", err)
+	}
+
 	dir, err := ioutil.TempDir("/var/tmp", "archiso")
 	if err != nil {
 		log.Fatal(err)
@@ -17,8 +32,89 @@ func TestArchiso(t *testing.T) {
 	// defer os.RemoveAll(dir)
 	fmt.Println(dir)
 
-	archiso := newArchiso()
-	archiso.TmpPath = "/var/tmp/archiso483364085"
+	archiso.TmpPath = dir
 	archiso.Path = dir
-	archiso.Init()
+	if err := archiso.Init(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadISOCorruptMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archiso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	signer, err := openpgp.NewEntity("Release", "", "release@archlinux.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyringPath := path.Join(dir, "archlinux.gpg")
+	keyring, err := os.Create(keyringPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Serialize(keyring); err != nil {
+		t.Fatal(err)
+	}
+	keyring.Close()
+
+	name := "archlinux-bootstrap-2020.01.01-x86_64.tar.zst"
+	tarball := "pristine root"
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, signer, strings.NewReader(tarball), nil); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(tarball))
+	newMirror := func(content string) *httptest.Server {
+		files := map[string]string{
+			"/iso/2020.01.01/" + name:          content,
+			"/iso/2020.01.01/" + name + ".sig": sig.String(),
+			"/iso/2020.01.01/sha256sums.txt":   hex.EncodeToString(sum[:]) + "  " + name + "\n",
+		}
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			content, ok := files[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(content))
+		}))
+	}
+	corrupt := newMirror("corrupt root")
+	defer corrupt.Close()
+	good := newMirror(tarball)
+	defer good.Close()
+
+	a := &Archiso{
+		Mirror:        corrupt.URL + "/iso/2020.01.01/",
+		ISOName:       name,
+		IsoURLs:       []string{corrupt.URL + "/iso/", good.URL + "/iso/"},
+		Keyring:       keyringPath,
+		ChecksumFiles: []string{"sha256sums.txt"},
+		TmpPath:       path.Join(dir, "cache"),
+	}
+	if err := os.Mkdir(a.TmpPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	isoPath, err := a.DownloadISO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(isoPath); err != nil || string(buf) != tarball {
+		t.Errorf("expected the tarball of the second mirror, got %q: %v", buf, err)
+	}
+
+	// Nothing is left behind once every mirror failed
+	a.IsoURLs = []string{corrupt.URL + "/iso/"}
+	os.Remove(isoPath)
+	if _, err := a.DownloadISO(); err == nil {
+		t.Fatal("expected an error for a corrupt tarball")
+	}
+	for _, filename := range []string{isoPath, isoPath + ".sig", isoPath + ".sha256sums.txt"} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s of the corrupt tarball was kept", path.Base(filename))
+		}
+	}
 }
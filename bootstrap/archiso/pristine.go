@@ -0,0 +1,160 @@
+package archiso
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+// releaseName strips the extension of a tarball name, which leaves the
+// release and architecture
+func releaseName(isoName string) string {
+	if i := strings.Index(isoName, ".tar"); i != -1 {
+		return isoName[:i]
+	}
+	return isoName
+}
+
+// tarballStamp identifies the tarball a pristine root was extracted from
+type tarballStamp struct {
+	Sum     string
+	Size    int64
+	ModTime int64
+}
+
+func readStamp(filename string) (tarballStamp, error) {
+	var s tarballStamp
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return s, err
+	}
+	if _, err := fmt.Sscan(string(buf), &s.Sum, &s.Size, &s.ModTime); err != nil {
+		return s, fmt.Errorf("Invalid stamp %s: %s", filename, err)
+	}
+	return s, nil
+}
+
+// tarballSum returns the SHA-256 of the tarball. It is only hashed again if
+// its size or modification time differ from the stamp.
+func tarballSum(isoPath string, stamp tarballStamp) (tarballStamp, error) {
+	info, err := os.Stat(isoPath)
+	if err != nil {
+		return stamp, err
+	}
+	current := tarballStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	if stamp.Sum != "" && stamp.Size == current.Size && stamp.ModTime == current.ModTime {
+		current.Sum = stamp.Sum
+		return current, nil
+	}
+	current.Sum, err = utils.FileChecksum(isoPath, sha256.New)
+	return current, err
+}
+
+// Pristine returns the extracted root of the tarball kept below
+// IsoCacheDir/roots. It is extracted again if the tarball changed since. The
+// returned lock is shared and keeps the root from being replaced or removed
+// until it is unlocked.
+func (a *Archiso) Pristine(isoPath string) (string, *utils.FileLock, error) {
+	rootsDir := path.Join(a.TmpPath, "roots")
+	if err := os.MkdirAll(rootsDir, 0755); err != nil {
+		return "", nil, err
+	}
+	root := path.Join(rootsDir, releaseName(a.ISOName))
+	lock, err := utils.LockFile(root+".lock", root)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := a.extract(isoPath, root); err != nil {
+		lock.Unlock()
+		return "", nil, err
+	}
+	if err := lock.Share(); err != nil {
+		lock.Unlock()
+		return "", nil, err
+	}
+	a.removeStale(rootsDir)
+	return root, lock, nil
+}
+
+// extract extracts the tarball to root unless it is there already, the
+// caller holds the lock of root
+func (a *Archiso) extract(isoPath, root string) error {
+	// The checksum of the tarball is written once the root is complete
+	stamp := root + ".sha256"
+	old, _ := readStamp(stamp)
+	current, err := tarballSum(isoPath, old)
+	if err != nil {
+		return err
+	}
+	if current.Sum == old.Sum {
+		if current != old {
+			// Touched but unchanged, skip the hashing next time
+			writeStamp(stamp, current)
+		}
+		return nil
+	}
+
+	utils.Msg2f("Extracting %s...", a.ISOName)
+	os.Remove(stamp)
+	tmpRoot := root + ".part"
+	for _, dir := range []string{root, tmpRoot} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	if a.Cloner != nil {
+		if err := a.Cloner.MakeRoot(tmpRoot); err != nil {
+			return err
+		}
+	}
+	if err := utils.Extract(isoPath, tmpRoot, a.StripComponents); err != nil {
+		return fmt.Errorf("Could not untar ISO: %s", err)
+	}
+	if err := os.Rename(tmpRoot, root); err != nil {
+		return err
+	}
+	return writeStamp(stamp, current)
+}
+
+// removeStale removes the pristine roots whose tarball is no longer cached.
+// Roots another process holds the lock of are kept.
+func (a *Archiso) removeStale(rootsDir string) {
+	cached := make(map[string]bool)
+	files, _ := ioutil.ReadDir(a.TmpPath)
+	for _, file := range files {
+		if !file.IsDir() && strings.Contains(file.Name(), ".tar") {
+			cached[releaseName(file.Name())] = true
+		}
+	}
+	roots, _ := ioutil.ReadDir(rootsDir)
+	for _, info := range roots {
+		name := strings.TrimSuffix(info.Name(), ".part")
+		if !info.IsDir() || cached[name] {
+			continue
+		}
+		root := path.Join(rootsDir, name)
+		// The lock file stays, removing it would let a waiting process lock
+		// a file nobody else sees
+		lock, err := utils.TryLockFile(root + ".lock")
+		if err != nil {
+			continue
+		}
+		utils.Msg2f("Removing %s, its tarball is no longer cached", root)
+		os.Remove(root + ".sha256")
+		for _, dir := range []string{root, root + ".part"} {
+			if err := os.RemoveAll(dir); err != nil {
+				utils.Warningf("Could not remove %s: %s", dir, err)
+			}
+		}
+		lock.Unlock()
+	}
+}
+
+func writeStamp(filename string, s tarballStamp) error {
+	return ioutil.WriteFile(filename, []byte(fmt.Sprintf("%s %d %d\n", s.Sum, s.Size, s.ModTime)), 0644)
+}
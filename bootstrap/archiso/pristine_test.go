@@ -0,0 +1,121 @@
+package archiso
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+// writeTarball writes a gzip compressed tarball with the given files
+func writeTarball(t *testing.T, filename string, files map[string]string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+}
+
+type fakeCloner struct {
+	mu    sync.Mutex
+	roots []string
+}
+
+func (f *fakeCloner) MakeRoot(dir string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.roots = append(f.roots, dir)
+	return os.MkdirAll(dir, 0755)
+}
+
+func (f *fakeCloner) Clone(src, dst string) error {
+	return utils.CloneTree(src, dst)
+}
+
+func TestPristine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archiso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cloner := &fakeCloner{}
+	a := &Archiso{ISOName: "archlinux-bootstrap-2020.02.01-x86_64.tar.gz", TmpPath: dir, Cloner: cloner}
+	isoPath := path.Join(dir, a.ISOName)
+	writeTarball(t, isoPath, map[string]string{"etc/os-release": "NAME=\"Arch Linux\"\n"})
+
+	// A stale root of a tarball which is gone and one which is in use
+	stale := path.Join(dir, "roots", "archlinux-bootstrap-2020.01.01-x86_64")
+	busy := path.Join(dir, "roots", "archlinux-bootstrap-2019.12.01-x86_64")
+	for _, root := range []string{stale, busy} {
+		if err := os.MkdirAll(path.Join(root, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	busyLock, err := utils.LockFile(busy+".lock", busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busyLock.Unlock()
+
+	// Concurrent runs extract the tarball once
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			root, lock, err := a.Pristine(isoPath)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer lock.Unlock()
+			if _, err := os.Stat(path.Join(root, "etc/os-release")); err != nil {
+				errs[i] = err
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := path.Join(dir, "roots", "archlinux-bootstrap-2020.02.01-x86_64")
+	if len(cloner.roots) != 1 || cloner.roots[0] != root+".part" {
+		t.Errorf("expected the root to be made by the cloner once, got %v", cloner.roots)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stale root was kept")
+	}
+	if _, err := os.Stat(busy); err != nil {
+		t.Error("root in use was removed")
+	}
+
+	// An unchanged tarball is not extracted again
+	if err := ioutil.WriteFile(path.Join(root, "marker"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, lock, err := a.Pristine(isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+	if _, err := os.Stat(path.Join(root, "marker")); err != nil {
+		t.Error("unchanged tarball was extracted again")
+	}
+}
@@ -0,0 +1,145 @@
+package archiso
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+var (
+	// Release directories in the iso/ listing of a mirror
+	releasePattern = regexp.MustCompile(`\b(\d{4}\.\d{2}\.\d{2})/`)
+
+	// Newer releases are compressed with zstd
+	bootstrapExtensions = []string{".tar.zst", ".tar.gz"}
+
+	// How many months we look back when the mirror can't be listed
+	fallbackMonths = 3
+)
+
+func bootstrapName(version, arch, ext string) string {
+	return fmt.Sprintf("archlinux-bootstrap-%s-%s%s", version, arch, ext)
+}
+
+// findRelease looks for the bootstrap tarball of a release in releaseURL
+func findRelease(releaseURL, version, arch string) (string, bool) {
+	for _, ext := range bootstrapExtensions {
+		name := bootstrapName(version, arch, ext)
+		if utils.URLExists(releaseURL + name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ListReleases parses the iso/ directory listing of a mirror and returns the
+// release versions, newest first
+func ListReleases(isoURL string) ([]string, error) {
+	listing, err := utils.Fetch(isoURL)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var releases []string
+	for _, match := range releasePattern.FindAllStringSubmatch(string(listing), -1) {
+		if seen[match[1]] {
+			continue
+		}
+		seen[match[1]] = true
+		releases = append(releases, match[1])
+	}
+	if len(releases) == 0 {
+		return nil, fmt.Errorf("No releases listed on %s", isoURL)
+	}
+	// YYYY.MM.DD sorts lexically
+	sort.Sort(sort.Reverse(sort.StringSlice(releases)))
+	return releases, nil
+}
+
+// latestRelease resolves the tarball behind the latest/ symlink through the
+// checksums published next to it, which list the versioned name as well
+func latestRelease(latestURL, arch string) (string, bool) {
+	sums, err := utils.Fetch(latestURL + "sha256sums.txt")
+	if err != nil {
+		return "", false
+	}
+	versioned := regexp.MustCompile(`^archlinux-bootstrap-\d{4}\.\d{2}\.\d{2}-` + regexp.QuoteMeta(arch) + `\.tar\.(gz|zst)$`)
+	scanner := bufio.NewScanner(strings.NewReader(string(sums)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if name := strings.TrimPrefix(fields[1], "*"); versioned.MatchString(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ResolveRelease finds the newest bootstrap tarball for arch below the iso/
+// directory of a mirror. It tries the directory listing, then the latest/
+// symlink and finally guesses the monthly releases of the last months.
+// Returns the URL of the release directory and the tarball name.
+func ResolveRelease(isoURL, arch string) (string, string, error) {
+	if releases, err := ListReleases(isoURL); err == nil {
+		for _, version := range releases {
+			releaseURL := isoURL + version + "/"
+			if name, ok := findRelease(releaseURL, version, arch); ok {
+				return releaseURL, name, nil
+			}
+		}
+	}
+	if name, ok := latestRelease(isoURL+"latest/", arch); ok {
+		return isoURL + "latest/", name, nil
+	}
+	t := time.Now()
+	for i := 0; i <= fallbackMonths; i++ {
+		month := time.Date(t.Year(), t.Month()-time.Month(i), 1, 0, 0, 0, 0, time.UTC)
+		version := month.Format("2006.01.02")
+		releaseURL := isoURL + version + "/"
+		if name, ok := findRelease(releaseURL, version, arch); ok {
+			return releaseURL, name, nil
+		}
+	}
+	return "", "", fmt.Errorf("Could not find a bootstrap tarball for %s on %s", arch, isoURL)
+}
+
+// PinnedRelease returns the release directory and tarball name of a specific
+// release, preferring a tarball already in cacheDir
+func PinnedRelease(isoURL, cacheDir, version, arch string) (string, string, error) {
+	releaseURL := isoURL + version + "/"
+	for _, ext := range bootstrapExtensions {
+		name := bootstrapName(version, arch, ext)
+		if _, err := os.Stat(filepath.Join(cacheDir, name)); err == nil {
+			return releaseURL, name, nil
+		}
+	}
+	if name, ok := findRelease(releaseURL, version, arch); ok {
+		return releaseURL, name, nil
+	}
+	return "", "", fmt.Errorf("Release %s has no bootstrap tarball for %s", version, arch)
+}
+
+// CachedRelease returns the newest bootstrap tarball for arch in cacheDir
+func CachedRelease(cacheDir, arch string) (string, bool) {
+	var names []string
+	for _, ext := range bootstrapExtensions {
+		matches, _ := filepath.Glob(filepath.Join(cacheDir, bootstrapName("*", arch, ext)))
+		for _, match := range matches {
+			names = append(names, filepath.Base(match))
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names[0], true
+}
@@ -0,0 +1,235 @@
+package archiso
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+// newMirror serves an iso/ directory with the given files, the listing of
+// iso/ links the release directories
+func newMirror(t *testing.T, files ...string) (*httptest.Server, *int32) {
+	var requests int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch {
+		case r.URL.Path == "/iso/":
+			seen := make(map[string]bool)
+			for _, file := range files {
+				if release := path.Dir(file); release != "." && !seen[release] {
+					seen[release] = true
+					fmt.Fprintf(w, "<a href=\"%s/\">%s/</a>\n", release, release)
+				}
+			}
+		case r.URL.Path == "/iso/latest/sha256sums.txt":
+			for _, file := range files {
+				if strings.HasPrefix(file, "latest/") {
+					fmt.Fprintf(w, "0000  %s\n", path.Base(file))
+				}
+			}
+		default:
+			for _, file := range files {
+				if r.URL.Path == "/iso/"+file {
+					return
+				}
+			}
+			http.NotFound(w, r)
+		}
+	}))
+	return mirror, &requests
+}
+
+func TestListReleases(t *testing.T) {
+	mirror, _ := newMirror(t,
+		"2020.01.01/archlinux-bootstrap-2020.01.01-x86_64.tar.gz",
+		"2020.03.01/archlinux-bootstrap-2020.03.01-x86_64.tar.zst",
+		"2020.02.01/archlinux-bootstrap-2020.02.01-x86_64.tar.gz",
+		"2020.02.01/archlinux-bootstrap-2020.02.01-x86_64.tar.gz.sig",
+	)
+	defer mirror.Close()
+	releases, err := ListReleases(mirror.URL + "/iso/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(releases, []string{"2020.03.01", "2020.02.01", "2020.01.01"}) {
+		t.Errorf("unexpected releases %v", releases)
+	}
+
+	empty, _ := newMirror(t)
+	defer empty.Close()
+	if _, err := ListReleases(empty.URL + "/iso/"); err == nil {
+		t.Error("expected an error for a listing without releases")
+	}
+}
+
+func TestResolveRelease(t *testing.T) {
+	// The newest release has no tarball yet
+	mirror, _ := newMirror(t,
+		"2020.03.01/archlinux-bootstrap-2020.03.01-x86_64.tar.zst.sig",
+		"2020.02.01/archlinux-bootstrap-2020.02.01-x86_64.tar.zst",
+		"2020.01.01/archlinux-bootstrap-2020.01.01-x86_64.tar.gz",
+	)
+	defer mirror.Close()
+	isoURL := mirror.URL + "/iso/"
+	releaseURL, name, err := ResolveRelease(isoURL, "x86_64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if releaseURL != isoURL+"2020.02.01/" || name != "archlinux-bootstrap-2020.02.01-x86_64.tar.zst" {
+		t.Errorf("unexpected release %s %s", releaseURL, name)
+	}
+
+	releaseURL, name, err = PinnedRelease(isoURL, "", "2020.01.01", "x86_64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if releaseURL != isoURL+"2020.01.01/" || name != "archlinux-bootstrap-2020.01.01-x86_64.tar.gz" {
+		t.Errorf("unexpected pinned release %s %s", releaseURL, name)
+	}
+	if _, _, err := PinnedRelease(isoURL, "", "2019.12.01", "x86_64"); err == nil {
+		t.Error("expected an error for a missing release")
+	}
+}
+
+func TestResolveLatestRelease(t *testing.T) {
+	// Mirrors without listings still have latest/
+	mirror, _ := newMirror(t,
+		"latest/archlinux-bootstrap-x86_64.tar.zst",
+		"latest/archlinux-bootstrap-2020.04.01-x86_64.tar.zst",
+	)
+	defer mirror.Close()
+	isoURL := mirror.URL + "/iso/"
+	releaseURL, name, err := ResolveRelease(isoURL, "x86_64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if releaseURL != isoURL+"latest/" || name != "archlinux-bootstrap-2020.04.01-x86_64.tar.zst" {
+		t.Errorf("unexpected release %s %s", releaseURL, name)
+	}
+}
+
+func TestCachedRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archiso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, ok := CachedRelease(dir, "x86_64"); ok {
+		t.Error("expected no cached release")
+	}
+	for _, name := range []string{
+		"archlinux-bootstrap-2020.01.01-x86_64.tar.gz",
+		"archlinux-bootstrap-2020.02.01-x86_64.tar.zst",
+		"archlinux-bootstrap-2020.03.01-aarch64.tar.zst",
+	} {
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name, ok := CachedRelease(dir, "x86_64"); !ok || name != "archlinux-bootstrap-2020.02.01-x86_64.tar.zst" {
+		t.Errorf("unexpected cached release %q", name)
+	}
+
+	// A pinned release in the cache needs no mirror
+	mirror, requests := newMirror(t)
+	defer mirror.Close()
+	_, name, err := PinnedRelease(mirror.URL+"/iso/", dir, "2020.01.01", "x86_64")
+	if n := atomic.LoadInt32(requests); err != nil || name != "archlinux-bootstrap-2020.01.01-x86_64.tar.gz" || n != 0 {
+		t.Errorf("unexpected pinned release %q, %d requests: %v", name, n, err)
+	}
+
+	// Without a reachable mirror the newest cached release is used
+	a := &Archiso{IsoURLs: []string{mirror.URL + "/iso/"}, Architecture: "x86_64", TmpPath: dir}
+	if err := a.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if a.ISOName != "archlinux-bootstrap-2020.02.01-x86_64.tar.zst" || a.Mirror != mirror.URL+"/iso/latest/" {
+		t.Errorf("unexpected release %s %s", a.Mirror, a.ISOName)
+	}
+}
+
+func TestResolveStalledMirror(t *testing.T) {
+	defer func(timeout time.Duration) { utils.RequestTimeout = timeout }(utils.RequestTimeout)
+	utils.RequestTimeout = 50 * time.Millisecond
+	done := make(chan struct{})
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer mirror.Close()
+	defer close(done)
+
+	start := time.Now()
+	if _, err := ListReleases(mirror.URL + "/iso/"); err == nil {
+		t.Error("expected an error for a stalled mirror")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("listing a stalled mirror took %s", elapsed)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archiso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	etag := `"1"`
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+	}))
+	defer mirror.Close()
+
+	a := &Archiso{Mirror: mirror.URL + "/os/", ISOName: "ArchLinuxARM-aarch64-latest.tar.gz", TmpPath: dir, Refresh: true}
+	isoPath := path.Join(dir, a.ISOName)
+	cache := func(validator string) {
+		for _, filename := range []string{isoPath, isoPath + ".sig"} {
+			if err := ioutil.WriteFile(filename, []byte("cached"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(isoPath+".validator", []byte(validator), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache(`"1"`)
+	if validator := a.refresh(isoPath); validator != `"1"` {
+		t.Errorf("unexpected validator %s", validator)
+	}
+	if _, err := os.Stat(isoPath); err != nil {
+		t.Error("unchanged tarball was removed")
+	}
+
+	etag = `"2"`
+	if validator := a.refresh(isoPath); validator != `"2"` {
+		t.Errorf("unexpected validator %s", validator)
+	}
+	for _, filename := range []string{isoPath, isoPath + ".sig", isoPath + ".validator"} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s of the replaced tarball was kept", path.Base(filename))
+		}
+	}
+
+	// An unreachable mirror keeps the cache
+	cache(`"1"`)
+	mirror.Close()
+	if validator := a.refresh(isoPath); validator != "" {
+		t.Errorf("unexpected validator %s", validator)
+	}
+	if _, err := os.Stat(isoPath); err != nil {
+		t.Error("tarball was removed without reaching the mirror")
+	}
+}
@@ -2,6 +2,8 @@ package bootstrap
 
 import (
 	"os"
+
+	"github.com/foxboron/devtools/backend"
 )
 
 type BootstrapType int
@@ -9,12 +11,21 @@ type BootstrapType int
 const (
 	Archiso BootstrapType = iota
 	Pacstrap
+	Offline
+	OCI
 )
 
 type Bootstrap interface {
 	Init(path string) error
 }
 
+// Cached is implemented by bootstraps keeping a pristine root which new roots
+// are populated from with the cheapest mechanism of the backend
+type Cached interface {
+	Bootstrap
+	SetCloner(cloner backend.Cloner)
+}
+
 func DefaultBootstrap() BootstrapType {
 	if _, err := os.Stat("/usr/bin/pacstrap"); os.IsNotExist(err) {
 		return Archiso
@@ -22,13 +33,25 @@ func DefaultBootstrap() BootstrapType {
 	return Pacstrap
 }
 
-func GetBootstrap(name string) BootstrapType {
+// LookupBootstrap returns the bootstrap with the given name
+func LookupBootstrap(name string) (BootstrapType, bool) {
 	switch name {
 	case "archiso":
-		return Archiso
+		return Archiso, true
 	case "pacstrap":
-		return Pacstrap
-	default:
-		return DefaultBootstrap()
+		return Pacstrap, true
+	case "offline":
+		return Offline, true
+	case "oci":
+		return OCI, true
+	}
+	return -1, false
+}
+
+// GetBootstrap returns the bootstrap with the given name, or the default one
+func GetBootstrap(name string) BootstrapType {
+	if bootstrapType, ok := LookupBootstrap(name); ok {
+		return bootstrapType
 	}
+	return DefaultBootstrap()
 }
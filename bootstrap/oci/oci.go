@@ -0,0 +1,357 @@
+package oci
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+
+	defaultDomain = "docker.io"
+	defaultTag    = "latest"
+)
+
+var (
+	// Media types of manifests pointing to other manifests
+	indexMediaTypes = map[string]bool{
+		"application/vnd.oci.image.index.v1+json":                   true,
+		"application/vnd.docker.distribution.manifest.list.v2+json": true,
+	}
+
+	// pacman architecture -> OCI platform architecture
+	platforms = map[string]string{
+		"x86_64":  "amd64",
+		"i686":    "386",
+		"aarch64": "arm64",
+		"armv7h":  "arm",
+		"riscv64": "riscv64",
+	}
+)
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *platform         `json:"platform"`
+}
+
+type index struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	Layers []descriptor `json:"layers"`
+}
+
+// manifest.json written by docker save
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// OCI bootstraps a root from an OCI image layout or a docker save tarball,
+// e.g. of archlinux:base-devel
+type OCI struct {
+	// Image is the tarball, or an OCI image layout directory
+	Image string
+	// Reference selects the image if there are several, e.g.
+	// archlinux:base-devel. The first image is used if empty.
+	Reference    string
+	Architecture string
+}
+
+// normalizeReference splits an image reference into its repository and tag
+// the way docker does, e.g. archlinux becomes docker.io/library/archlinux and
+// latest. A digest is returned as the tag.
+func normalizeReference(reference string) (string, string) {
+	repository, tag := reference, ""
+	if i := strings.Index(repository, "@"); i != -1 {
+		repository, tag = repository[:i], repository[i+1:]
+	} else if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository, tag = repository[:i], repository[i+1:]
+	}
+	if tag == "" {
+		tag = defaultTag
+	}
+	domain, remainder := defaultDomain, repository
+	if i := strings.Index(repository, "/"); i != -1 {
+		first := repository[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			domain, remainder = first, repository[i+1:]
+		}
+	}
+	if domain == "index.docker.io" {
+		domain = defaultDomain
+	}
+	if domain == defaultDomain && !strings.Contains(remainder, "/") {
+		remainder = "library/" + remainder
+	}
+	return domain + "/" + remainder, tag
+}
+
+// matchReference compares the requested reference with the name of an image.
+// Both have to name the same repository and tag after normalization.
+func matchReference(reference, name string) bool {
+	if reference == "" {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	repository, tag := normalizeReference(reference)
+	nameRepository, nameTag := normalizeReference(name)
+	return repository == nameRepository && tag == nameTag
+}
+
+// matchRefName compares the requested reference with the ref.name annotation
+// of an OCI layout, which may only be a tag
+func matchRefName(reference, name string) bool {
+	if reference == "" || strings.ContainsAny(name, "/:@") {
+		return matchReference(reference, name)
+	}
+	_, tag := normalizeReference(reference)
+	return name != "" && tag == name
+}
+
+func readJSON(filename string, v interface{}) error {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("Could not parse %s: %s", filename, err)
+	}
+	return nil
+}
+
+// blobPath returns the path of a blob in an OCI image layout and makes sure
+// it matches its digest
+func blobPath(layout, digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || strings.ContainsAny(parts[1], "/.") {
+		return "", fmt.Errorf("Unsupported digest %s", digest)
+	}
+	blob := path.Join(layout, "blobs", parts[0], parts[1])
+	if err := utils.VerifyChecksum(blob, parts[1], sha256.New); err != nil {
+		return "", err
+	}
+	return blob, nil
+}
+
+// resolveManifest walks image indexes down to the image manifest for our
+// architecture
+func (o *OCI) resolveManifest(layout string, desc descriptor) ([]string, error) {
+	blob, err := blobPath(layout, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if indexMediaTypes[desc.MediaType] {
+		var idx index
+		if err := readJSON(blob, &idx); err != nil {
+			return nil, err
+		}
+		return o.selectManifest(layout, idx.Manifests, false)
+	}
+	var m manifest
+	if err := readJSON(blob, &m); err != nil {
+		return nil, err
+	}
+	var layers []string
+	for _, layer := range m.Layers {
+		layerPath, err := blobPath(layout, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layerPath)
+	}
+	return layers, nil
+}
+
+// selectManifest picks the manifest matching Reference, on the top level
+// index, and Architecture
+func (o *OCI) selectManifest(layout string, manifests []descriptor, top bool) ([]string, error) {
+	for _, desc := range manifests {
+		if top && !matchRefName(o.Reference, desc.Annotations[refNameAnnotation]) {
+			continue
+		}
+		if desc.Platform != nil && o.Architecture != "" && desc.Platform.Architecture != platforms[o.Architecture] {
+			continue
+		}
+		return o.resolveManifest(layout, desc)
+	}
+	return nil, fmt.Errorf("No image for %s %s in %s", o.Reference, o.Architecture, o.Image)
+}
+
+// Layers returns the layer tarballs of the image in the order they are
+// applied. Images are read from the unpacked tarball in dir.
+func (o *OCI) Layers(dir string) ([]string, error) {
+	// docker save, which also writes this for OCI layouts since docker 25
+	if _, err := os.Stat(path.Join(dir, "manifest.json")); err == nil {
+		var manifests []dockerManifest
+		if err := readJSON(path.Join(dir, "manifest.json"), &manifests); err != nil {
+			return nil, err
+		}
+		for _, m := range manifests {
+			match := o.Reference == ""
+			for _, tag := range m.RepoTags {
+				if matchReference(o.Reference, tag) {
+					match = true
+				}
+			}
+			if !match {
+				continue
+			}
+			var layers []string
+			for _, layer := range m.Layers {
+				layerPath, err := securePath(dir, layer)
+				if err != nil {
+					return nil, err
+				}
+				layers = append(layers, layerPath)
+			}
+			return layers, nil
+		}
+		return nil, fmt.Errorf("No image %s in %s", o.Reference, o.Image)
+	}
+	var idx index
+	if err := readJSON(path.Join(dir, "index.json"), &idx); err != nil {
+		return nil, fmt.Errorf("%s is neither an OCI image layout nor a docker save tarball", o.Image)
+	}
+	return o.selectManifest(dir, idx.Manifests, true)
+}
+
+func securePath(dir, name string) (string, error) {
+	p := filepath.Join(dir, name)
+	if !strings.HasPrefix(p, filepath.Clean(dir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Layer %s is outside of the image", name)
+	}
+	return p, nil
+}
+
+// applyLayer extracts a layer on top of the previous ones. Whiteouts remove
+// files of the layers below.
+func applyLayer(e *utils.Extractor, layer string) error {
+	f, err := os.Open(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stream, err := utils.DecompressReader(f)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// Opaque whiteouts only hide what is below, not what this layer adds
+	created := make(map[string]bool)
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Could not read layer %s: %s", layer, err)
+		}
+		dir, base := path.Split(header.Name)
+		switch {
+		case base == whiteoutOpaque:
+			dirPath, _, err := e.Path(path.Join(dir, "."))
+			if err != nil {
+				return err
+			}
+			if dirPath == "" {
+				dirPath = e.Target
+			}
+			entries, _ := ioutil.ReadDir(dirPath)
+			for _, entry := range entries {
+				entryPath := path.Join(dirPath, entry.Name())
+				if created[entryPath] {
+					continue
+				}
+				if err := os.RemoveAll(entryPath); err != nil {
+					return err
+				}
+			}
+		case strings.HasPrefix(base, whiteoutPrefix):
+			hidden, ok, err := e.Path(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := os.RemoveAll(hidden); err != nil {
+				return err
+			}
+		default:
+			dst, err := e.Entry(header, tarReader)
+			if err != nil {
+				return err
+			}
+			created[dst] = true
+		}
+	}
+	return nil
+}
+
+func (o *OCI) Init(dst string) error {
+	layout := o.Image
+	if info, err := os.Stat(o.Image); err != nil {
+		return err
+	} else if !info.IsDir() {
+		tmp, err := ioutil.TempDir("/var/tmp", "oci")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		utils.Msg2f("Unpacking %s...", o.Image)
+		if err := utils.Extract(o.Image, tmp, 0); err != nil {
+			return fmt.Errorf("Could not unpack image: %s", err)
+		}
+		layout = tmp
+	}
+	layers, err := o.Layers(layout)
+	if err != nil {
+		return err
+	}
+	e, err := utils.NewExtractor(dst, 0)
+	if err != nil {
+		return err
+	}
+	for i, layer := range layers {
+		utils.Msg2f("Applying layer %d/%d", i+1, len(layers))
+		if err := applyLayer(e, layer); err != nil {
+			return err
+		}
+	}
+	return e.Finish()
+}
+
+func NewOCI(Image, Reference, Architecture string) *OCI {
+	return &OCI{
+		Image:        Image,
+		Reference:    Reference,
+		Architecture: Architecture,
+	}
+}
@@ -0,0 +1,190 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type entry struct {
+	name     string
+	contents string
+	dir      bool
+}
+
+func layerTar(t *testing.T, entries []entry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.contents))}
+		if e.dir {
+			hdr = &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.contents))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+var layers = [][]entry{
+	{
+		{name: "etc/", dir: true},
+		{name: "etc/pacman.conf", contents: "base"},
+		{name: "etc/removed", contents: "base"},
+		{name: "usr/share/doc/", dir: true},
+		{name: "usr/share/doc/old", contents: "base"},
+	},
+	{
+		{name: "etc/.wh.removed"},
+		{name: "etc/pacman.conf", contents: "devel"},
+		{name: "usr/share/doc/", dir: true},
+		{name: "usr/share/doc/.wh..wh..opq"},
+		{name: "usr/share/doc/new", contents: "devel"},
+	},
+}
+
+func checkRoot(t *testing.T, root string) {
+	if buf, err := ioutil.ReadFile(path.Join(root, "etc/pacman.conf")); err != nil || string(buf) != "devel" {
+		t.Errorf("upper layer did not replace etc/pacman.conf: %v", err)
+	}
+	for _, removed := range []string{"etc/removed", "usr/share/doc/old"} {
+		if _, err := os.Stat(path.Join(root, removed)); err == nil {
+			t.Errorf("%s was not removed by the whiteout", removed)
+		}
+	}
+	if _, err := os.Stat(path.Join(root, "usr/share/doc/new")); err != nil {
+		t.Errorf("opaque directory lost the new file: %v", err)
+	}
+}
+
+func TestDockerSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := path.Join(dir, "image")
+	m := dockerManifest{RepoTags: []string{"archlinux:base-devel"}}
+	for i, layer := range layers {
+		name := path.Join(string(rune('a'+i)), "layer.tar")
+		os.MkdirAll(path.Join(image, path.Dir(name)), 0755)
+		if err := ioutil.WriteFile(path.Join(image, name), layerTar(t, layer), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m.Layers = append(m.Layers, name)
+	}
+	buf, _ := json.Marshal([]dockerManifest{m})
+	if err := ioutil.WriteFile(path.Join(image, "manifest.json"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := path.Join(dir, "root")
+	if err := NewOCI(image, "docker.io/library/archlinux:base-devel", "x86_64").Init(root); err != nil {
+		t.Fatal(err)
+	}
+	checkRoot(t, root)
+
+	for _, reference := range []string{"archlinux:base", "base-devel", "latest"} {
+		if err := NewOCI(image, reference, "x86_64").Init(path.Join(dir, "other")); err == nil {
+			t.Errorf("expected a missing image %s to fail", reference)
+		}
+	}
+}
+
+func TestMatchReference(t *testing.T) {
+	for _, tc := range []struct {
+		reference, name string
+		expected        bool
+	}{
+		{"", "archlinux:latest", true},
+		{"archlinux", "archlinux:latest", true},
+		{"archlinux:latest", "docker.io/library/archlinux:latest", true},
+		{"docker.io/library/archlinux", "archlinux", true},
+		{"index.docker.io/library/archlinux:base", "archlinux:base", true},
+		{"latest", "archlinux:latest", false},
+		{"latest", "latest", true},
+		{"latest", "library/latest", true},
+		{"base-devel", "archlinux:base-devel", false},
+		{"archlinux:base", "archlinux:base-devel", false},
+		{"archlinux", "foo/archlinux", false},
+		{"ghcr.io/archlinux/archlinux:latest", "archlinux/archlinux:latest", false},
+		{"localhost:5000/archlinux:base", "localhost:5000/archlinux:base", true},
+		{"localhost:5000/archlinux", "localhost:5000/archlinux:base", false},
+		{"archlinux", "", false},
+	} {
+		if match := matchReference(tc.reference, tc.name); match != tc.expected {
+			t.Errorf("matchReference(%q, %q) = %v, expected %v", tc.reference, tc.name, match, tc.expected)
+		}
+	}
+}
+
+func TestMatchRefName(t *testing.T) {
+	for _, tc := range []struct {
+		reference, name string
+		expected        bool
+	}{
+		{"archlinux:base-devel", "base-devel", true},
+		{"archlinux", "latest", true},
+		{"base-devel", "base-devel", false},
+		{"archlinux:base", "base-devel", false},
+		{"archlinux:base", "docker.io/library/archlinux:base", true},
+		{"archlinux:base", "", false},
+	} {
+		if match := matchRefName(tc.reference, tc.name); match != tc.expected {
+			t.Errorf("matchRefName(%q, %q) = %v, expected %v", tc.reference, tc.name, match, tc.expected)
+		}
+	}
+}
+
+func writeBlob(t *testing.T, layout string, buf []byte) string {
+	sum := sha256.Sum256(buf)
+	digest := hex.EncodeToString(sum[:])
+	blobs := path.Join(layout, "blobs", "sha256")
+	os.MkdirAll(blobs, 0755)
+	if err := ioutil.WriteFile(path.Join(blobs, digest), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return "sha256:" + digest
+}
+
+func TestOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layout := path.Join(dir, "layout")
+
+	var m manifest
+	for _, layer := range layers {
+		m.Layers = append(m.Layers, descriptor{Digest: writeBlob(t, layout, layerTar(t, layer))})
+	}
+	buf, _ := json.Marshal(m)
+	amd64 := descriptor{Digest: writeBlob(t, layout, buf), Platform: &platform{Architecture: "amd64", OS: "linux"}}
+	arm64 := descriptor{Digest: writeBlob(t, layout, []byte("{}")), Platform: &platform{Architecture: "arm64", OS: "linux"}}
+	buf, _ = json.Marshal(index{Manifests: []descriptor{arm64, amd64}})
+	top := descriptor{
+		MediaType:   "application/vnd.oci.image.index.v1+json",
+		Digest:      writeBlob(t, layout, buf),
+		Annotations: map[string]string{refNameAnnotation: "base-devel"},
+	}
+	buf, _ = json.Marshal(index{Manifests: []descriptor{top}})
+	if err := ioutil.WriteFile(path.Join(layout, "index.json"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := path.Join(dir, "root")
+	if err := NewOCI(layout, "archlinux:base-devel", "x86_64").Init(root); err != nil {
+		t.Fatal(err)
+	}
+	checkRoot(t, root)
+}
@@ -0,0 +1,208 @@
+package offline
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/foxboron/devtools/repo"
+	"github.com/foxboron/devtools/utils"
+)
+
+// Defaults
+var (
+	PacmanConf string = "/etc/pacman.conf"
+	DBPath            = "/var/lib/pacman/"
+)
+
+// Offline bootstraps a root without network access. The packages are
+// resolved from the sync databases of the host and installed from the
+// package cache.
+type Offline struct {
+	PacmanConf string
+	// DBPath of the host, the sync databases are read from DBPath/sync
+	DBPath string
+	// Repos in the order of pacman.conf
+	Repos []string
+	// PackageDirs are searched for the resolved package files
+	PackageDirs []string
+	Packages    []string
+	// Architecture of the packages, the one of PacmanConf if empty
+	Architecture string
+}
+
+// Databases reads the sync databases of the configured repositories
+func (o *Offline) Databases() ([][]*repo.Package, error) {
+	var dbs [][]*repo.Package
+	for _, name := range o.Repos {
+		dbPath := path.Join(o.DBPath, "sync", name+".db")
+		packages, err := repo.ReadDatabase(dbPath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read sync database %s: %s", name, err)
+		}
+		dbs = append(dbs, packages)
+	}
+	return dbs, nil
+}
+
+// Resolve returns the dependency closure of the packages, groups are
+// expanded. Earlier databases take precedence like they do for pacman.
+func Resolve(dbs [][]*repo.Package, targets []string) ([]*repo.Package, error) {
+	byName := make(map[string]*repo.Package)
+	provides := make(map[string][]*repo.Package)
+	groups := make(map[string][]*repo.Package)
+	for _, db := range dbs {
+		for _, pkg := range db {
+			if _, ok := byName[pkg.Name]; ok {
+				continue
+			}
+			byName[pkg.Name] = pkg
+			for _, provide := range pkg.Provides {
+				name := repo.DepName(provide)
+				provides[name] = append(provides[name], pkg)
+			}
+			for _, group := range pkg.Groups {
+				groups[group] = append(groups[group], pkg)
+			}
+		}
+	}
+
+	var queue []*repo.Package
+	for _, target := range targets {
+		if pkg, ok := byName[target]; ok {
+			queue = append(queue, pkg)
+		} else if members, ok := groups[target]; ok {
+			queue = append(queue, members...)
+		} else {
+			return nil, fmt.Errorf("Target not found: %s", target)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var closure []*repo.Package
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		if seen[pkg.Name] {
+			continue
+		}
+		seen[pkg.Name] = true
+		closure = append(closure, pkg)
+		for _, dep := range pkg.Depends {
+			name := repo.DepName(dep)
+			if satisfier, ok := byName[name]; ok {
+				queue = append(queue, satisfier)
+				continue
+			}
+			candidates := provides[name]
+			if len(candidates) == 0 {
+				return nil, fmt.Errorf("Could not satisfy dependency %s of %s", dep, pkg.Name)
+			}
+			// Prefer a provider we already install
+			satisfier := candidates[0]
+			for _, candidate := range candidates {
+				if seen[candidate.Name] {
+					satisfier = candidate
+					break
+				}
+			}
+			queue = append(queue, satisfier)
+		}
+	}
+	return closure, nil
+}
+
+// findPackage looks for the package file in the package directories
+func (o *Offline) findPackage(pkg *repo.Package) (string, bool) {
+	for _, dir := range o.PackageDirs {
+		pkgPath := path.Join(dir, pkg.Filename)
+		if _, err := os.Stat(pkgPath); err == nil {
+			return pkgPath, true
+		}
+	}
+	return "", false
+}
+
+// PackageFiles resolves the packages and returns their files from the
+// package directories
+func (o *Offline) PackageFiles() ([]string, error) {
+	dbs, err := o.Databases()
+	if err != nil {
+		return nil, err
+	}
+	closure, err := Resolve(dbs, o.Packages)
+	if err != nil {
+		return nil, err
+	}
+	var files, missing []string
+	for _, pkg := range closure {
+		pkgPath, ok := o.findPackage(pkg)
+		if !ok {
+			missing = append(missing, pkg.Filename)
+			continue
+		}
+		files = append(files, pkgPath)
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("Packages missing from %s: %s", strings.Join(o.PackageDirs, ", "), strings.Join(missing, " "))
+	}
+	return files, nil
+}
+
+func (o *Offline) Init(dst string) error {
+	files, err := o.PackageFiles()
+	if err != nil {
+		return err
+	}
+	utils.Msg2f("Installing %d packages from the package cache", len(files))
+	pacmanConf := o.PacmanConf
+	if o.Architecture != "" {
+		if pacmanConf, err = utils.ArchitecturePacmanConf(o.PacmanConf, o.Architecture); err != nil {
+			return err
+		}
+		defer os.Remove(pacmanConf)
+	}
+	argArr := []string{"-C", pacmanConf, "-c", "-M", "-U", dst}
+	argArr = append(argArr, files...)
+	cmd := exec.Command("/usr/bin/pacstrap", argArr...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pacstrap failed: %s", err)
+	}
+	// The sync databases let pacman in the container install from the cache
+	syncDir := path.Join(dst, "var", "lib", "pacman", "sync")
+	if err := os.MkdirAll(syncDir, 0755); err != nil {
+		return err
+	}
+	for _, name := range o.Repos {
+		db := name + ".db"
+		if err := utils.CopyFile(path.Join(o.DBPath, "sync", db), path.Join(syncDir, db)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewOffline(PacmanConf string) (*Offline, error) {
+	pacmanconf, err := utils.GetPacmanConf(PacmanConf)
+	if err != nil {
+		return nil, err
+	}
+	dbPath := pacmanconf.DBPath
+	if dbPath == "" {
+		dbPath = DBPath
+	}
+	var repos []string
+	for _, v := range pacmanconf.Repos {
+		repos = append(repos, v.Name)
+	}
+	return &Offline{
+		PacmanConf:  PacmanConf,
+		DBPath:      dbPath,
+		Repos:       repos,
+		PackageDirs: pacmanconf.CacheDir,
+		Packages:    []string{"base-devel"},
+	}, nil
+}
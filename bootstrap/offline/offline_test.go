@@ -0,0 +1,53 @@
+package offline
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/foxboron/devtools/repo"
+)
+
+func names(packages []*repo.Package) []string {
+	var n []string
+	for _, pkg := range packages {
+		n = append(n, pkg.Name)
+	}
+	sort.Strings(n)
+	return n
+}
+
+func TestResolve(t *testing.T) {
+	core := []*repo.Package{
+		{Name: "bash", Provides: []string{"sh"}, Depends: []string{"glibc", "readline>=7.0"}},
+		{Name: "glibc"},
+		{Name: "readline", Depends: []string{"glibc"}},
+		{Name: "make", Groups: []string{"base-devel"}, Depends: []string{"sh"}},
+		{Name: "gcc", Groups: []string{"base-devel"}, Depends: []string{"glibc"}},
+		{Name: "unrelated"},
+	}
+	extra := []*repo.Package{
+		{Name: "glibc", Depends: []string{"unrelated"}},
+	}
+	closure, err := Resolve([][]*repo.Package{core, extra}, []string{"base-devel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := names(closure)
+	expected := []string{"bash", "gcc", "glibc", "make", "readline"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+
+	if _, err := Resolve([][]*repo.Package{core}, []string{"missing"}); err == nil {
+		t.Error("expected missing target to fail")
+	}
+	broken := append(core, &repo.Package{Name: "broken", Depends: []string{"nothing"}})
+	if _, err := Resolve([][]*repo.Package{broken}, []string{"broken"}); err == nil {
+		t.Error("expected unsatisfiable dependency to fail")
+	}
+}
@@ -1,12 +1,14 @@
 package pacstrap
 
 import (
+	"bytes"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
 
-	alpm "github.com/Jguer/go-alpm"
+	"github.com/foxboron/devtools/utils"
 )
 
 // Defaults
@@ -21,43 +23,99 @@ type Pacstrap struct {
 	PacmanConf string
 	Flags      string // GMcd
 	Packages   []string
+
+	// HookDirs are passed to pacman as additional hook directories
+	HookDirs []string
+	// NoScriptlet skips the install scriptlets of the packages
+	NoScriptlet bool
+	// Architecture of the packages, the one of PacmanConf if empty. The
+	// servers of PacmanConf have to carry packages for it.
+	Architecture string
 }
 
-func (p *Pacstrap) Init(path string) error {
-	var cmd *exec.Cmd
+// PacstrapError is returned when pacstrap fails. Output holds the last lines
+// pacstrap printed.
+type PacstrapError struct {
+	ExitCode int
+	Output   string
+}
+
+func (e *PacstrapError) Error() string {
+	return fmt.Sprintf("pacstrap exited with status %d:\n%s", e.ExitCode, e.Output)
+}
+
+// Lines of output kept for PacstrapError
+const outputLines = 20
+
+// newPacstrapError returns a PacstrapError with the last lines of output
+func newPacstrapError(exitCode int, output string) *PacstrapError {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > outputLines {
+		lines = lines[len(lines)-outputLines:]
+	}
+	return &PacstrapError{
+		ExitCode: exitCode,
+		Output:   strings.Join(lines, "\n"),
+	}
+}
+
+// Args returns the arguments for pacstrap. Everything after the root is
+// handed to pacman by pacstrap.
+func (p *Pacstrap) Args(path string) []string {
 	argArr := make([]string, 0)
-	argArr = append(argArr, "sudo")
-	argArr = append(argArr, "/usr/bin/pacstrap")
-	argArr = append(argArr, "-"+p.Flags)
+	if p.Flags != "" {
+		argArr = append(argArr, "-"+p.Flags)
+	}
 	if p.PacmanConf != "" {
-		argArr = append(argArr, "-C "+p.PacmanConf)
+		argArr = append(argArr, "-C", p.PacmanConf)
 	}
 	// append root directory
 	argArr = append(argArr, path)
 	// Append packages we want
-	for _, v := range p.Packages {
-		argArr = append(argArr, v)
+	argArr = append(argArr, p.Packages...)
+	for _, cachedir := range p.Cachedirs {
+		argArr = append(argArr, "--cachedir="+cachedir)
 	}
-	cmd = exec.Command(argArr[0], argArr[1:]...)
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("Can't setup locale")
+	for _, hookdir := range p.HookDirs {
+		argArr = append(argArr, "--hookdir="+hookdir)
 	}
-
-	return nil
+	if p.NoScriptlet {
+		argArr = append(argArr, "--noscriptlet")
+	}
+	return argArr
 }
 
-func NewPacstrap(PacmanConf string) *Pacstrap {
-	b, err := os.Open(PacmanConf)
-	if err != nil {
-		fmt.Print(err)
+func (p *Pacstrap) Init(path string) error {
+	args := p.Args(path)
+	if p.Architecture != "" {
+		conf, err := utils.ArchitecturePacmanConf(p.PacmanConf, p.Architecture)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(conf)
+		pacstrap := *p
+		pacstrap.PacmanConf = conf
+		args = pacstrap.Args(path)
 	}
-	defer b.Close()
+	var cmd *exec.Cmd
+	var output bytes.Buffer
+	cmd = exec.Command("/usr/bin/pacstrap", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, &output)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &output)
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return newPacstrapError(exitErr.ExitCode(), output.String())
+	} else if err != nil {
+		return fmt.Errorf("Could not run pacstrap: %s", err)
+	}
+	return nil
+}
 
-	pacmanconf, err := alpm.ParseConfig(b)
+func NewPacstrap(PacmanConf string) (*Pacstrap, error) {
+	pacmanconf, err := utils.GetPacmanConf(PacmanConf)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return &Pacstrap{
@@ -67,6 +125,5 @@ func NewPacstrap(PacmanConf string) *Pacstrap {
 		PacmanConf: PacmanConf,
 		Cachedirs:  pacmanconf.CacheDir,
 		Packages:   []string{"base-devel"},
-	}
-
+	}, nil
 }
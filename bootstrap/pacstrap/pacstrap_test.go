@@ -5,12 +5,22 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
 func TestPacstrap(t *testing.T) {
 	fmt.Println()
 
+	pacstrap, err := NewPacstrap(PacmanConf)
+	if err != nil {
+		t.Skipf("Needs the pacman.conf of an Arch Linux host: %s", err)
+	}
+	if _, err := os.Stat("/usr/bin/pacstrap"); err != nil || os.Geteuid() != 0 {
+		t.Skip("Needs pacstrap and root")
+	}
+
 	dir, err := ioutil.TempDir("/var/tmp", "pacstrap")
 	if err != nil {
 		log.Fatal(err)
@@ -18,7 +28,63 @@ func TestPacstrap(t *testing.T) {
 	defer os.RemoveAll(dir)
 	fmt.Println(dir)
 
-	pacstrap := newPacstrap()
 	pacstrap.Path = dir
-	pacstrap.init()
+	if err := pacstrap.Init(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		pacstrap Pacstrap
+		expected []string
+	}{
+		{
+			name:     "packages",
+			pacstrap: Pacstrap{Flags: "GMcd", PacmanConf: "/etc/pacman.conf", Packages: []string{"base-devel", "git"}},
+			expected: []string{"-GMcd", "-C", "/etc/pacman.conf", "/root", "base-devel", "git"},
+		},
+		{
+			name:     "cachedir",
+			pacstrap: Pacstrap{Packages: []string{"base-devel"}, Cachedirs: []string{"/var/cache/pacman/pkg", "/srv/pkg"}},
+			expected: []string{"/root", "base-devel", "--cachedir=/var/cache/pacman/pkg", "--cachedir=/srv/pkg"},
+		},
+		{
+			name:     "hookdir",
+			pacstrap: Pacstrap{Packages: []string{"base-devel"}, HookDirs: []string{"/etc/devtools/hooks"}},
+			expected: []string{"/root", "base-devel", "--hookdir=/etc/devtools/hooks"},
+		},
+		{
+			name:     "noscriptlet",
+			pacstrap: Pacstrap{Packages: []string{"base-devel"}, Cachedirs: []string{"/srv/pkg"}, NoScriptlet: true},
+			expected: []string{"/root", "base-devel", "--cachedir=/srv/pkg", "--noscriptlet"},
+		},
+	} {
+		if args := test.pacstrap.Args("/root"); !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, args)
+		}
+	}
+}
+
+func TestPacstrapError(t *testing.T) {
+	var output []string
+	for i := 1; i <= 30; i++ {
+		output = append(output, fmt.Sprintf("line %d", i))
+	}
+	err := newPacstrapError(1, strings.Join(output, "\n")+"\n")
+	if err.ExitCode != 1 {
+		t.Errorf("unexpected exit code %d", err.ExitCode)
+	}
+	if expected := strings.Join(output[10:], "\n"); err.Output != expected {
+		t.Errorf("expected the last 20 lines, got %q", err.Output)
+	}
+	if !strings.HasPrefix(err.Error(), "pacstrap exited with status 1:\nline 11\n") {
+		t.Errorf("unexpected error %q", err)
+	}
+
+	short := newPacstrapError(2, "error: target not found: foo\n")
+	if short.Output != "error: target not found: foo" {
+		t.Errorf("unexpected output %q", short.Output)
+	}
 }
@@ -0,0 +1,67 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+var (
+	// ConfigDirs are searched in order for the repository and architecture
+	// specific configs, pacman.conf.d/<repo>.conf and makepkg.conf.d/<arch>.conf
+	ConfigDirs = []string{"/etc/devtools", "/usr/share/devtools"}
+
+	archbuildSuffix = "-build"
+)
+
+// ParseArchbuildName splits the name of an archbuild entrypoint, e.g.
+// extra-x86_64-build or multilib-testing-x86_64-build, into the repository
+// and architecture
+func ParseArchbuildName(name string) (string, string, bool) {
+	if !strings.HasSuffix(name, archbuildSuffix) {
+		return "", "", false
+	}
+	name = strings.TrimSuffix(name, archbuildSuffix)
+	i := strings.LastIndex(name, "-")
+	if i < 1 {
+		return "", "", false
+	}
+	repo, arch := name[:i], name[i+1:]
+	if _, ok := utils.Architectures[arch]; !ok {
+		return "", "", false
+	}
+	return repo, arch, true
+}
+
+// findConfig returns the first existing file name in dirs
+func findConfig(dirs []string, name string) (string, error) {
+	for _, dir := range dirs {
+		filename := path.Join(dir, name)
+		if _, err := os.Stat(filename); err == nil {
+			return filename, nil
+		}
+	}
+	return "", fmt.Errorf("Could not find %s in %s", name, strings.Join(dirs, ", "))
+}
+
+// RepositoryPacmanConf returns the pacman.conf for building against repo
+func RepositoryPacmanConf(dirs []string, repo string) (string, error) {
+	return findConfig(dirs, path.Join("pacman.conf.d", repo+".conf"))
+}
+
+// ArchitectureMakepkgConf returns the makepkg.conf for building for arch
+func ArchitectureMakepkgConf(dirs []string, arch string) (string, error) {
+	return findConfig(dirs, path.Join("makepkg.conf.d", arch+".conf"))
+}
+
+// RootPath returns the root of a repository and architecture below
+// buildPath, every combination gets its own
+func RootPath(buildPath, repo, arch string) string {
+	if arch == "" {
+		arch = utils.HostArchitecture()
+	}
+	return path.Join(buildPath, repo+"-"+arch, "root")
+}
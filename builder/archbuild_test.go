@@ -0,0 +1,141 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseArchbuildName(t *testing.T) {
+	for _, tc := range []struct {
+		name, repo, arch string
+		ok               bool
+	}{
+		{"extra-x86_64-build", "extra", "x86_64", true},
+		{"multilib-testing-x86_64-build", "multilib-testing", "x86_64", true},
+		{"kde-unstable-aarch64-build", "kde-unstable", "aarch64", true},
+		{"extra-sparc-build", "", "", false},
+		{"x86_64-build", "", "", false},
+		{"buildpkg", "", "", false},
+	} {
+		repo, arch, ok := ParseArchbuildName(tc.name)
+		if repo != tc.repo || arch != tc.arch || ok != tc.ok {
+			t.Errorf("%s: got %q %q %v", tc.name, repo, arch, ok)
+		}
+	}
+}
+
+func TestRepositoryConfigs(t *testing.T) {
+	tb, be, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "archbuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	user, shipped := path.Join(dir, "user"), path.Join(dir, "shipped")
+	for _, filename := range []string{
+		path.Join(shipped, "pacman.conf.d", "extra.conf"),
+		path.Join(shipped, "pacman.conf.d", "multilib.conf"),
+		path.Join(shipped, "makepkg.conf.d", "x86_64.conf"),
+		path.Join(user, "pacman.conf.d", "multilib.conf"),
+	} {
+		if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte("[core]\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testingConf := path.Join(shipped, "pacman.conf.d", "testing.conf")
+	if err := ioutil.WriteFile(testingConf, []byte("[core-testing]\n\n[core]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for repo, expected := range map[string]string{
+		"extra":    path.Join(shipped, "pacman.conf.d", "extra.conf"),
+		"multilib": path.Join(user, "pacman.conf.d", "multilib.conf"),
+	} {
+		b, err := NewBuilder(RootPath(tb.Path, repo, "x86_64"),
+			WithBackendImpl(be),
+			WithContainerImpl(c),
+			WithBootstrapImpl(tb.Bootstrap),
+			WithRepository(repo),
+			WithArchitecture("x86_64"),
+			WithConfigDirs(user, shipped),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.PacmanConf != expected {
+			t.Errorf("%s: expected %s, got %s", repo, expected, b.PacmanConf)
+		}
+		if b.MakepkgConf != path.Join(shipped, "makepkg.conf.d", "x86_64.conf") {
+			t.Errorf("%s: unexpected makepkg.conf %s", repo, b.MakepkgConf)
+		}
+		if b.Path != path.Join(tb.Path, repo+"-x86_64", "root") {
+			t.Errorf("%s: unexpected root %s", repo, b.Path)
+		}
+	}
+
+	// The repository configs are what pacman and makepkg in the root read
+	b, err := NewBuilder(RootPath(tb.Path, "testing", "x86_64"),
+		WithBackendImpl(be),
+		WithContainerImpl(c),
+		WithBootstrapImpl(tb.Bootstrap),
+		WithRepository("testing"),
+		WithArchitecture("x86_64"),
+		WithConfigDirs(user, shipped),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for filename, expected := range map[string]string{
+		containerPacmanConf:  testingConf,
+		containerMakepkgConf: path.Join(shipped, "makepkg.conf.d", "x86_64.conf"),
+	} {
+		buf, err := ioutil.ReadFile(path.Join(b.ContainerPath, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, err := ioutil.ReadFile(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(buf), string(source)) {
+			t.Errorf("%s is not %s:\n%s", filename, expected, buf)
+		}
+	}
+
+	// The host configs are used for a repository and architecture without
+	defer func(pacmanConf, makepkgConf string) {
+		DefaultPacmanConf, DefaultMakepkgConf = pacmanConf, makepkgConf
+	}(DefaultPacmanConf, DefaultMakepkgConf)
+	DefaultPacmanConf = path.Join(dir, "pacman.conf")
+	DefaultMakepkgConf = path.Join(dir, "makepkg.conf")
+	for _, filename := range []string{DefaultPacmanConf, DefaultMakepkgConf} {
+		if err := ioutil.WriteFile(filename, []byte("[options]\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err = NewBuilder(tb.Path,
+		WithBackendImpl(be),
+		WithContainerImpl(c),
+		WithBootstrapImpl(tb.Bootstrap),
+		WithRepository("staging"),
+		WithArchitecture("aarch64"),
+		WithConfigDirs(user, shipped),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.PacmanConf != DefaultPacmanConf || b.MakepkgConf != DefaultMakepkgConf {
+		t.Errorf("expected the host configs, got %s and %s", b.PacmanConf, b.MakepkgConf)
+	}
+}
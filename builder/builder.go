@@ -2,24 +2,34 @@ package builder
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/foxboron/devtools/backend"
 	"github.com/foxboron/devtools/bootstrap"
 	"github.com/foxboron/devtools/container"
 	"github.com/foxboron/devtools/makepkg"
+	"github.com/foxboron/devtools/repo"
 	"github.com/foxboron/devtools/utils"
 )
 
 const (
-	makepkgArgs    = "syncdeps --noconfirm --log --holdver --skipinteg"
-	makepkgCommand = "sudo --preserve-env=SOURCE_DATE_EPOCH -iu builduser bash -c 'cd /startdir; makepkg \"$@\"' -bash "
+	makepkgArgs     = "--syncdeps --noconfirm --log --holdver --skipinteg"
+	makepkgDepsArgs = "--syncdeps --noconfirm --verifysource --skipinteg"
+	makepkgCommand  = "sudo --preserve-env=SOURCE_DATE_EPOCH -iu builduser bash -c 'cd /startdir; makepkg \"$@\"' -bash "
 )
 
 var (
 	// Fixed paths
 	hostGnupgPath = path.Join("/etc", "pacman.d", "gnupg")
+	// Where InstallPackages are copied to in the snapshot
+	installPath = "/var/cache/devtools/install"
+
+	// Fetches the sources on the host, replaced in tests
+	downloadSources = DownloadSources
 )
 
 type Builder struct {
@@ -32,12 +42,37 @@ type Builder struct {
 	Architecture  string
 	MakepkgConf   string
 	PacmanConf    string
+
+	// Offline containers are upgraded from the package cache without
+	// refreshing the sync databases
+	Offline bool
+
+	// NoSetarch skips the linux32 personality for i686 builds on x86_64
+	NoSetarch bool
+
+	// BuildNetwork keeps the host network available during build().
+	// By default the container is isolated once the dependencies are installed.
+	BuildNetwork bool
+
+	// InstallPackages are package files installed into every snapshot, e.g.
+	// an unreleased dependency
+	InstallPackages []string
+
+	// StartDir is the directory of the PKGBUILD, the working directory when
+	// empty. Packages without PKGDEST are put there as well.
+	StartDir string
+
+	// Output gets the output of the build, stdout when nil
+	Output io.Writer
+
+	// LocalRepo gets the built packages and is available to every snapshot
+	LocalRepo *LocalRepo
 }
 
 func (b *Builder) Build() (map[string]map[string]string, error) {
 	var files = make(map[string]map[string]string)
 
-	if err := DownloadSources(b); err != nil {
+	if err := downloadSources(b); err != nil {
 		return files, fmt.Errorf("Could not download sources: %s", err)
 	}
 	srcdest := makepkg.MakepkgConf("SRCDEST")
@@ -45,23 +80,58 @@ func (b *Builder) Build() (map[string]map[string]string, error) {
 		srcdest = path.Join(b.ContainerPath, "srcdest")
 	}
 	b.Container.SetBindDir(srcdest, "/srcdest")
-	pwd, err := os.Getwd()
+	startdir, err := b.startDir()
 	if err != nil {
 		return files, err
 	}
-	b.Container.SetBindDir(pwd, "/startdir")
+	b.Container.SetBindDir(startdir, "/startdir")
+	// Dependencies are the last thing we need the network for
+	if err := b.Container.Exec(makepkgCommand + makepkgDepsArgs); err != nil {
+		return files, fmt.Errorf("Could not install dependencies: %s", err)
+	}
+	if !b.BuildNetwork {
+		b.Container.SetPrivateNetwork(true)
+		defer b.Container.SetPrivateNetwork(false)
+	}
 	if err := b.Container.Exec(makepkgCommand + makepkgArgs); err != nil {
 		return files, err
 	}
-	files, err = utils.MoveProducts(b.Container)
+	files, err = utils.MoveProducts(b.Container, startdir)
 	if err != nil {
 		return files, err
 	}
+	if b.LocalRepo != nil {
+		var packages []string
+		for _, dest := range files["PKGDEST"] {
+			packages = append(packages, dest)
+		}
+		if err := b.LocalRepo.Add(packages...); err != nil {
+			return files, fmt.Errorf("Could not add packages to the local repository: %s", err)
+		}
+	}
 	return files, nil
 }
 
+// SetOutput sends the output of the build to w
+func (b *Builder) SetOutput(w io.Writer) {
+	b.Output = w
+	b.Container.SetOutput(w)
+}
+
+// startDir returns the absolute StartDir
+func (b *Builder) startDir() (string, error) {
+	if b.StartDir == "" {
+		return os.Getwd()
+	}
+	return filepath.Abs(b.StartDir)
+}
+
 // Init initializes the container
 func (b *Builder) Init() error {
+	// Foreign architectures need their emulator even for existing containers
+	if err := utils.SetupArchitecture(b.Container, b.Architecture, !b.NoSetarch); err != nil {
+		return err
+	}
 	// No need to initialize an initialized container
 	if backend.CheckContainerExists(b.Path) {
 		return nil
@@ -74,7 +144,12 @@ func (b *Builder) Init() error {
 	// Point the container to the correct container
 	b.ContainerPath = ContainerPath
 	b.Container.SetPath(b.ContainerPath)
-	//
+	// Let cached bootstraps populate the root the way the backend does best
+	if cached, ok := b.Bootstrap.(bootstrap.Cached); ok {
+		if cloner, ok := b.Backend.(backend.Cloner); ok {
+			cached.SetCloner(cloner)
+		}
+	}
 	if err := b.Bootstrap.Init(b.ContainerPath); err != nil {
 		return err
 	}
@@ -82,6 +157,9 @@ func (b *Builder) Init() error {
 	if err := SetupConfig(b.ContainerPath, b.PacmanConf, b.MakepkgConf); err != nil {
 		return err
 	}
+	if err := SetPacmanArchitecture(b.ContainerPath, b.Architecture); err != nil {
+		return err
+	}
 	// Create the initial files in the container
 	if err := CreateFiles(b.ContainerPath, InitFileMap); err != nil {
 		return err
@@ -95,7 +173,7 @@ func (b *Builder) Init() error {
 		return err
 	}
 	// Upgrade packages in the container
-	if err := b.Container.Exec("pacman -Syu --noconfirm base-devel"); err != nil {
+	if err := b.Container.Exec(b.upgradeCommand() + " base-devel"); err != nil {
 		return err
 	}
 	return nil
@@ -113,14 +191,39 @@ func (b *Builder) SetupChrootConfig() error {
 	})
 }
 
+func (b *Builder) upgradeCommand() string {
+	if b.Offline {
+		return "pacman -Su --noconfirm"
+	}
+	return "pacman -Syu --noconfirm"
+}
+
 // Fork - Sets up a snapshot from the root container
 func (b *Builder) Fork(name string) error {
+	if err := b.Upgrade(); err != nil {
+		return err
+	}
+	return b.Snapshot(name)
+}
+
+// Upgrade brings the packages of the root up to date
+func (b *Builder) Upgrade() error {
 	if err := utils.SetupCacheDirs(b.Container, b.PacmanConf); err != nil {
 		return err
 	}
-	if err := b.Container.Exec("pacman -Syu --noconfirm"); err != nil {
+	if err := b.Container.Exec(b.upgradeCommand()); err != nil {
 		return fmt.Errorf("Could not upgrade packages in container")
 	}
+	return nil
+}
+
+// Snapshot sets up a snapshot from the root container as it is, several
+// snapshots of the same root may be taken at once
+func (b *Builder) Snapshot(name string) error {
+	// Bad packages should fail before we spend time on the snapshot
+	if err := b.checkInstallPackages(); err != nil {
+		return err
+	}
 	newContainerPath, err := b.Backend.AddSnapshot(name)
 	if err != nil {
 		return err
@@ -130,9 +233,66 @@ func (b *Builder) Fork(name string) error {
 	if err := b.SetupChrootConfig(); err != nil {
 		return err
 	}
+	if b.LocalRepo != nil {
+		if err := b.LocalRepo.setup(b); err != nil {
+			return err
+		}
+	}
+	return b.installPackages()
+}
+
+// checkInstallPackages makes sure InstallPackages are packages for our
+// architecture
+func (b *Builder) checkInstallPackages() error {
+	arch := b.Architecture
+	if arch == "" {
+		arch = utils.HostArchitecture()
+	}
+	for _, file := range b.InstallPackages {
+		if !repo.IsPackageFile(file) {
+			return fmt.Errorf("%s is not a package file", file)
+		}
+		pkg, err := repo.ReadPackage(file)
+		if err != nil {
+			return err
+		}
+		if pkg.Arch != "any" && pkg.Arch != arch {
+			return fmt.Errorf("%s is built for %s, not %s", file, pkg.Arch, arch)
+		}
+	}
+	return nil
+}
+
+// installPackages copies InstallPackages into the snapshot and installs them
+func (b *Builder) installPackages() error {
+	if len(b.InstallPackages) == 0 {
+		return nil
+	}
+	installDir := path.Join(b.ContainerPath, installPath)
+	if err := os.MkdirAll(installDir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(installDir)
+	command := "pacman -U --noconfirm --ask=4"
+	for _, file := range b.InstallPackages {
+		name := path.Base(file)
+		if err := utils.CopyFile(file, path.Join(installDir, name)); err != nil {
+			return fmt.Errorf("Could not copy %s into the snapshot: %s", file, err)
+		}
+		command += " " + shellQuote(path.Join(installPath, name))
+	}
+	utils.Msg2f("Installing %d local packages", len(b.InstallPackages))
+	if err := b.Container.Exec(command); err != nil {
+		return fmt.Errorf("Could not install local packages: %s", err)
+	}
 	return nil
 }
 
+// shellQuote quotes s as a single word for sh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 // Destroy - Removes a snapshot and defaults to root container
 func (b *Builder) Destroy(name string) error {
 	if err := b.Backend.RemoveSnapshot(name); err != nil {
@@ -143,11 +303,16 @@ func (b *Builder) Destroy(name string) error {
 	return nil
 }
 
-// Update runs an update and copies over configs in case anything has changed
-func (b *Builder) Update() error {
-	return SetupConfig(b.ContainerPath, b.PacmanConf, b.MakepkgConf)
+// Inspect opens an interactive shell as builduser in /build of the current
+// snapshot, e.g. to look at a failed build.
+func (b *Builder) Inspect() error {
+	return b.Container.Shell("sudo", "-iu", "builduser")
 }
 
-func NewBuilder() {
-	panic("NewBuilder: Not implemented")
+// Update runs an update and copies over configs in case anything has changed
+func (b *Builder) Update() error {
+	if err := SetupConfig(b.ContainerPath, b.PacmanConf, b.MakepkgConf); err != nil {
+		return err
+	}
+	return SetPacmanArchitecture(b.ContainerPath, b.Architecture)
 }
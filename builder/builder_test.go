@@ -0,0 +1,360 @@
+package builder
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	backend "github.com/foxboron/devtools/backend/fake"
+	container "github.com/foxboron/devtools/container/fake"
+)
+
+type fakeBootstrap struct {
+	dirs []string
+}
+
+func (f *fakeBootstrap) Init(root string) error {
+	for _, dir := range f.dirs {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newTestBuilder(t *testing.T) (*Builder, *backend.Backend, *container.Container, func()) {
+	dir, err := ioutil.TempDir("", "builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		hostGnupgPath = path.Join("/etc", "pacman.d", "gnupg")
+		os.RemoveAll(dir)
+	}
+
+	hostGnupgPath = path.Join(dir, "gnupg")
+	if err := os.MkdirAll(hostGnupgPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(hostGnupgPath, "pubring.gpg"), []byte("keys"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	confDir := path.Join(dir, "conf")
+	if err := os.MkdirAll(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pacmanConf := path.Join(confDir, "pacman.conf")
+	conf := "[options]\nCacheDir = " + path.Join(dir, "cache") + "\n\n[core]\nServer = https://example.org/$repo/os/$arch\n"
+	if err := ioutil.WriteFile(pacmanConf, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	makepkgConf := path.Join(confDir, "makepkg.conf")
+	if err := ioutil.WriteFile(makepkgConf, []byte("PKGEXT='.pkg.tar.zst'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dest := range []string{"PKGDEST", "LOGDEST", "SRCPKGDEST", "SRCDEST"} {
+		os.Setenv(dest, path.Join(dir, strings.ToLower(dest)))
+	}
+
+	rootPath := path.Join(dir, "root")
+	be := backend.NewBackend(rootPath)
+	c := container.NewContainer(rootPath)
+	b := &Builder{
+		Path:        rootPath,
+		Backend:     be,
+		Container:   c,
+		Bootstrap:   &fakeBootstrap{dirs: []string{"etc/pacman.d"}},
+		PacmanConf:  pacmanConf,
+		MakepkgConf: makepkgConf,
+	}
+	return b, be, c, cleanup
+}
+
+func TestInit(t *testing.T) {
+	b, be, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(be.Events, []string{"setup"}) {
+		t.Errorf("unexpected backend events %v", be.Events)
+	}
+	expected := []string{"locale-gen", "pacman -Syu --noconfirm base-devel"}
+	if !reflect.DeepEqual(c.Executed(), expected) {
+		t.Errorf("expected %v, got %v", expected, c.Executed())
+	}
+	for filename := range InitFileMap {
+		if _, err := os.Stat(path.Join(b.Path, filename)); err != nil {
+			t.Errorf("%s was not created: %s", filename, err)
+		}
+	}
+	for _, filename := range []string{containerPacmanConf, containerMakepkgConf} {
+		if _, err := os.Stat(path.Join(b.Path, filename)); err != nil {
+			t.Errorf("%s was not copied: %s", filename, err)
+		}
+	}
+	cacheDir := path.Join(path.Dir(b.Path), "cache")
+	if c.BindDirs[cacheDir] != cacheDir {
+		t.Errorf("cache directory is not bound: %v", c.BindDirs)
+	}
+}
+
+func TestBuildSequence(t *testing.T) {
+	b, be, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+	var downloaded bool
+	downloadSources = func(*Builder) error {
+		downloaded = true
+		return nil
+	}
+	defer func() { downloadSources = DownloadSources }()
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Fork("build"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := be.Snapshots["build"]
+	if b.ContainerPath != snapshot || c.GetPath() != snapshot {
+		t.Fatalf("builder was not moved to the snapshot %s", snapshot)
+	}
+
+	c.ExecFunc = func(command string) error {
+		if strings.HasSuffix(command, makepkgArgs) {
+			return createFile(path.Join(c.GetPath(), "pkgdest", "foo-1-1-any.pkg.tar.zst"))
+		}
+		return nil
+	}
+	for _, dest := range []string{"logdest", "srcpkgdest"} {
+		if err := os.MkdirAll(path.Join(snapshot, dest), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	products, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !downloaded {
+		t.Error("sources were not downloaded")
+	}
+	if _, ok := products["PKGDEST"]["foo-1-1-any.pkg.tar.zst"]; !ok {
+		t.Errorf("package was not moved: %v", products)
+	}
+
+	var deps, build *container.Command
+	for i, cmd := range c.Commands {
+		switch {
+		case strings.HasSuffix(cmd.Command, makepkgDepsArgs):
+			deps = &c.Commands[i]
+		case strings.HasSuffix(cmd.Command, makepkgArgs):
+			build = &c.Commands[i]
+		}
+	}
+	if deps == nil || build == nil {
+		t.Fatalf("makepkg was not run: %v", c.Executed())
+	}
+	if deps.PrivateNetwork || !build.PrivateNetwork {
+		t.Error("network should only be isolated during the build")
+	}
+	if deps.Path != snapshot || build.Path != snapshot {
+		t.Error("makepkg did not run in the snapshot")
+	}
+	if c.PrivateNetwork {
+		t.Error("network isolation was not reset after the build")
+	}
+
+	if err := b.Destroy("build"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"setup", "add build", "remove build"}
+	if !reflect.DeepEqual(be.Events, expected) {
+		t.Errorf("expected %v, got %v", expected, be.Events)
+	}
+	if b.ContainerPath != b.Path || c.GetPath() != b.Path {
+		t.Error("builder was not moved back to the root")
+	}
+}
+
+func TestBuildNetwork(t *testing.T) {
+	b, _, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+	b.BuildNetwork = true
+	downloadSources = func(*Builder) error { return nil }
+	defer func() { downloadSources = DownloadSources }()
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dest := range []string{"pkgdest", "logdest", "srcpkgdest"} {
+		if err := os.MkdirAll(path.Join(b.ContainerPath, dest), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range c.Commands {
+		if cmd.PrivateNetwork {
+			t.Errorf("%s ran without network", cmd.Command)
+		}
+	}
+}
+
+func TestBuildStartDir(t *testing.T) {
+	b, _, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+	downloadSources = func(*Builder) error { return nil }
+	defer func() { downloadSources = DownloadSources }()
+
+	startdir, err := ioutil.TempDir("", "startdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(startdir)
+	b.StartDir = startdir
+	// Without a PKGDEST packages end up next to the PKGBUILD
+	os.Unsetenv("PKGDEST")
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	c.ExecFunc = func(command string) error {
+		if strings.HasSuffix(command, makepkgArgs) {
+			return createFile(path.Join(c.GetPath(), "pkgdest", "foo-1-1-any.pkg.tar.zst"))
+		}
+		return nil
+	}
+	for _, dest := range []string{"logdest", "srcpkgdest"} {
+		if err := os.MkdirAll(path.Join(b.ContainerPath, dest), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	products, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BindDirs[startdir] != "/startdir" {
+		t.Errorf("start directory is not bound: %v", c.BindDirs)
+	}
+	expected := path.Join(startdir, "foo-1-1-any.pkg.tar.zst")
+	if products["PKGDEST"]["foo-1-1-any.pkg.tar.zst"] != expected {
+		t.Errorf("package was not moved to the start directory: %v", products)
+	}
+}
+
+func createFile(filename string) error {
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte{}, 0644)
+}
+
+// writePackage writes an uncompressed package with just a .PKGINFO
+func writePackage(t *testing.T, filename, name, arch string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pkginfo := "pkgname = " + name + "\npkgver = 1-1\narch = " + arch + "\n"
+	tw := tar.NewWriter(f)
+	tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(pkginfo))})
+	tw.Write([]byte(pkginfo))
+	tw.Close()
+}
+
+func TestForkInstallPackages(t *testing.T) {
+	b, _, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+	b.Architecture = "x86_64"
+	dir := path.Dir(b.Path)
+	foo := path.Join(dir, "foo-1-1-x86_64.pkg.tar")
+	bar := path.Join(dir, "bar-1-1-any.pkg.tar")
+	writePackage(t, foo, "foo", "x86_64")
+	writePackage(t, bar, "bar", "any")
+	b.InstallPackages = []string{foo, bar}
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var installed []string
+	c.ExecFunc = func(command string) error {
+		if strings.HasPrefix(command, "pacman -U") {
+			for _, file := range []string{foo, bar} {
+				if _, err := os.Stat(path.Join(c.GetPath(), installPath, path.Base(file))); err != nil {
+					t.Errorf("%s was not copied into the snapshot", file)
+				}
+			}
+			installed = append(installed, command)
+		}
+		return nil
+	}
+	if err := b.Fork("build"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "pacman -U --noconfirm --ask=4 '" + installPath + "/foo-1-1-x86_64.pkg.tar' '" + installPath + "/bar-1-1-any.pkg.tar'"
+	if len(installed) != 1 || installed[0] != expected {
+		t.Errorf("expected %q, got %q", expected, installed)
+	}
+	if _, err := os.Stat(path.Join(b.ContainerPath, installPath)); !os.IsNotExist(err) {
+		t.Error("packages were left in the snapshot")
+	}
+}
+
+func TestForkInstallPackagesQuoted(t *testing.T) {
+	b, _, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+	b.Architecture = "x86_64"
+	foo := path.Join(path.Dir(b.Path), "foo'; touch pwned; '-1-1-any.pkg.tar")
+	writePackage(t, foo, "foo", "any")
+	b.InstallPackages = []string{foo}
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var installed []string
+	c.ExecFunc = func(command string) error {
+		if strings.HasPrefix(command, "pacman -U") {
+			installed = append(installed, command)
+		}
+		return nil
+	}
+	if err := b.Fork("build"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "pacman -U --noconfirm --ask=4 '" + installPath + "/foo'\\''; touch pwned; '\\''-1-1-any.pkg.tar'"
+	if len(installed) != 1 || installed[0] != expected {
+		t.Errorf("expected %q, got %q", expected, installed)
+	}
+}
+
+func TestForkInvalidPackages(t *testing.T) {
+	b, be, _, cleanup := newTestBuilder(t)
+	defer cleanup()
+	b.Architecture = "x86_64"
+	dir := path.Dir(b.Path)
+	foreign := path.Join(dir, "foo-1-1-aarch64.pkg.tar")
+	writePackage(t, foreign, "foo", "aarch64")
+	notPackage := path.Join(dir, "PKGBUILD")
+	ioutil.WriteFile(notPackage, []byte("pkgname=foo\n"), 0644)
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{foreign, notPackage} {
+		b.InstallPackages = []string{file}
+		if err := b.Fork("build"); err == nil {
+			t.Errorf("%s: expected an error", path.Base(file))
+		}
+	}
+	if _, ok := be.Snapshots["build"]; ok {
+		t.Error("snapshot was created for invalid packages")
+	}
+}
@@ -4,16 +4,25 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/foxboron/devtools/utils"
 )
 
+var (
+	// Where pacman and makepkg in the container read their configuration
+	containerPacmanConf  = path.Join("etc", "pacman.conf")
+	containerMakepkgConf = path.Join("etc", "makepkg.conf")
+)
+
 // SetupPacman copies over the pacman.conf and makepkg.conf from Builder settings
-// and also scans the pacman.conf for any file inclusions we have to copy over
+// to /etc in the container and also scans the pacman.conf for any file
+// inclusions we have to copy over
 func SetupPacman(containerPath, PacmanConf, MakepkgConf string) error {
-	if err := utils.CopyFile(PacmanConf, path.Join(containerPath, PacmanConf)); err != nil {
+	if err := utils.CopyFile(PacmanConf, path.Join(containerPath, containerPacmanConf)); err != nil {
 		return fmt.Errorf("Could not copy pacman.conf from %s", PacmanConf)
 	}
 	pacmanconf, err := utils.GetPacmanConf(PacmanConf)
@@ -25,7 +34,7 @@ func SetupPacman(containerPath, PacmanConf, MakepkgConf string) error {
 			return fmt.Errorf("Could not copy pacman.conf from %s", PacmanConf)
 		}
 	}
-	if err := utils.CopyFile(MakepkgConf, path.Join(containerPath, MakepkgConf)); err != nil {
+	if err := utils.CopyFile(MakepkgConf, path.Join(containerPath, containerMakepkgConf)); err != nil {
 		return fmt.Errorf("Could not copy makepkg.conf from %s", MakepkgConf)
 	}
 	return nil
@@ -83,3 +92,59 @@ func SetupConfig(containerPath, PacmanConf, MakepkgConf string) error {
 	}
 	return SetupPacman(containerPath, PacmanConf, MakepkgConf)
 }
+
+// PacmanArchitecture returns the Architecture option of the pacman.conf in the
+// container. A missing option, file or "auto" returns an empty string.
+func PacmanArchitecture(containerPath string) (string, error) {
+	buf, err := ioutil.ReadFile(path.Join(containerPath, containerPacmanConf))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("Could not read pacman.conf in container: %s", err)
+	}
+	return utils.PacmanConfArchitecture(string(buf)), nil
+}
+
+// SetPacmanArchitecture sets the Architecture option in the pacman.conf copied
+// into the container. An empty arch leaves the host configuration untouched.
+func SetPacmanArchitecture(containerPath, arch string) error {
+	if arch == "" {
+		return nil
+	}
+	confPath := path.Join(containerPath, containerPacmanConf)
+	buf, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return fmt.Errorf("Could not read pacman.conf in container: %s", err)
+	}
+	return ioutil.WriteFile(confPath, []byte(utils.SetPacmanConfArchitecture(string(buf), arch)), 0644)
+}
+
+// AddPacmanRepository adds a repository in front of the others to the
+// pacman.conf copied into the container, so its packages win
+func AddPacmanRepository(containerPath, name, server string) error {
+	confPath := path.Join(containerPath, containerPacmanConf)
+	buf, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return fmt.Errorf("Could not read pacman.conf in container: %s", err)
+	}
+	section := []string{
+		"[" + name + "]",
+		"SigLevel = Optional TrustAll",
+		"Server = " + server,
+		"",
+	}
+	var lines []string
+	var done bool
+	for _, line := range strings.Split(string(buf), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !done && strings.HasPrefix(trimmed, "[") && trimmed != "[options]" {
+			lines = append(lines, section...)
+			done = true
+		}
+		lines = append(lines, line)
+	}
+	if !done {
+		lines = append(lines, append([]string{""}, section...)...)
+	}
+	return ioutil.WriteFile(confPath, []byte(strings.Join(lines, "\n")), 0644)
+}
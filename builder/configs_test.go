@@ -0,0 +1,141 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSetPacmanArchitecture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacmanconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(path.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		conf, expected string
+	}{
+		{
+			"[options]\nArchitecture = auto\n\n[core]\n",
+			"[options]\nArchitecture = aarch64\n\n[core]\n",
+		},
+		{
+			"[options]\n# Architecture = auto\n\n[core]\n",
+			"[options]\nArchitecture = aarch64\n\n[core]\n",
+		},
+		{
+			"[options]\n#Architecture = auto\nArchitecture = x86_64\n",
+			"[options]\nArchitecture = aarch64\n",
+		},
+		{
+			"[options]\nHoldPkg = pacman\n\n[core]\n# Architecture = auto\n",
+			"[options]\nArchitecture = aarch64\nHoldPkg = pacman\n\n[core]\n# Architecture = auto\n",
+		},
+	} {
+		conf := path.Join(dir, "etc", "pacman.conf")
+		if err := ioutil.WriteFile(conf, []byte(tc.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetPacmanArchitecture(dir, "aarch64"); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != tc.expected {
+			t.Errorf("unexpected pacman.conf for %q:\n%s", tc.conf, buf)
+		}
+	}
+}
+
+func TestPacmanArchitecture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacmanconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(path.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if arch, err := PacmanArchitecture(dir); err != nil || arch != "" {
+		t.Errorf("expected no architecture without pacman.conf, got %q, %v", arch, err)
+	}
+	for _, tc := range []struct {
+		conf, expected string
+	}{
+		{"[options]\nArchitecture = aarch64\n", "aarch64"},
+		{"[options]\nArchitecture = auto\n", ""},
+		{"[options]\n# Architecture = auto\n", ""},
+		{"[options]\n#Architecture = x86_64\nArchitecture = i686 x86_64\n", "i686"},
+		{"[options]\n\n[core]\nArchitecture = aarch64\n", ""},
+	} {
+		conf := path.Join(dir, "etc", "pacman.conf")
+		if err := ioutil.WriteFile(conf, []byte(tc.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		arch, err := PacmanArchitecture(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if arch != tc.expected {
+			t.Errorf("PacmanArchitecture(%q) = %q, expected %q", tc.conf, arch, tc.expected)
+		}
+	}
+}
+
+func TestPacmanConfSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacmanconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := path.Join(dir, "root")
+	if err := os.MkdirAll(path.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A repository config outside of /etc, like pacman.conf.d/testing.conf
+	source := path.Join(dir, "devtools", "pacman.conf.d", "testing.conf")
+	makepkgConf := path.Join(dir, "devtools", "makepkg.conf.d", "aarch64.conf")
+	for filename, content := range map[string]string{
+		source:      "[options]\n# Architecture = auto\n\n[core-testing]\n\n[core]\n",
+		makepkgConf: "CARCH=aarch64\n",
+	} {
+		if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := SetupPacman(root, source, makepkgConf); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetPacmanArchitecture(root, "aarch64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddPacmanRepository(root, "local", "file:///repo"); err != nil {
+		t.Fatal(err)
+	}
+	if arch, err := PacmanArchitecture(root); err != nil || arch != "aarch64" {
+		t.Errorf("expected aarch64, got %q, %v", arch, err)
+	}
+	buf, err := ioutil.ReadFile(path.Join(root, "etc", "pacman.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Architecture = aarch64\n", "[local]\n", "[core-testing]\n"} {
+		if !strings.Contains(string(buf), expected) {
+			t.Errorf("%q is missing from the root pacman.conf:\n%s", expected, buf)
+		}
+	}
+	if _, err := os.Stat(path.Join(root, source)); !os.IsNotExist(err) {
+		t.Errorf("pacman.conf was copied to its source path in the root")
+	}
+}
@@ -0,0 +1,113 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/foxboron/devtools/repo"
+	"github.com/foxboron/devtools/utils"
+)
+
+var (
+	// LocalRepoName is the name of the local repository in pacman.conf
+	LocalRepoName = "devtools-local"
+
+	// Where the local repository is mounted in the snapshot
+	localRepoPath = "/var/cache/devtools/local"
+
+	// Adds package files to a database, replaced in tests
+	repoAdd = repo.RepoAdd
+)
+
+// LocalRepo is a pacman repository of the packages built so far. Snapshots
+// get it in front of the other repositories, builds resolve dependencies on
+// freshly built packages with the usual syncdeps.
+type LocalRepo struct {
+	Name string
+	// Path holds the packages and the database
+	Path string
+	// Session repositories are removed with Remove
+	Session bool
+
+	mu sync.Mutex
+}
+
+// NewLocalRepo returns the persistent repository in dir
+func NewLocalRepo(dir string) (*LocalRepo, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create local repository: %s", err)
+	}
+	return &LocalRepo{Name: LocalRepoName, Path: dir}, nil
+}
+
+// NewSessionRepo returns a temporary repository, removed with Remove
+func NewSessionRepo() (*LocalRepo, error) {
+	dir, err := ioutil.TempDir("/var/tmp", "localrepo")
+	if err != nil {
+		return nil, fmt.Errorf("Could not create local repository: %s", err)
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalRepo{Name: LocalRepoName, Path: dir, Session: true}, nil
+}
+
+// DBPath returns the database of the repository, it does not exist before
+// the first package is added
+func (r *LocalRepo) DBPath() string {
+	return path.Join(r.Path, r.Name+".db.tar.gz")
+}
+
+// Add copies package files into the repository and adds them to the
+// database, replacing older versions
+func (r *LocalRepo) Add(files ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var added []string
+	for _, file := range files {
+		if !repo.IsPackageFile(file) {
+			continue
+		}
+		dest := path.Join(r.Path, path.Base(file))
+		if err := utils.CopyFile(file, dest); err != nil {
+			return fmt.Errorf("Could not copy %s into the local repository: %s", file, err)
+		}
+		added = append(added, dest)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	// The last build is what the next one should see, even if it is an
+	// older version
+	return repoAdd(r.DBPath(), true, false, added...)
+}
+
+// Remove deletes session repositories, persistent ones are kept
+func (r *LocalRepo) Remove() error {
+	if !r.Session {
+		return nil
+	}
+	return os.RemoveAll(r.Path)
+}
+
+// setup makes the repository available in a snapshot. The database is put
+// in place directly, so pacman does not need to refresh the others.
+func (r *LocalRepo) setup(b *Builder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := os.Stat(r.DBPath()); os.IsNotExist(err) {
+		return nil
+	}
+	syncDir := path.Join(b.ContainerPath, "var", "lib", "pacman", "sync")
+	if err := os.MkdirAll(syncDir, 0755); err != nil {
+		return err
+	}
+	if err := utils.CopyFile(r.DBPath(), path.Join(syncDir, r.Name+".db")); err != nil {
+		return fmt.Errorf("Could not copy the local repository into the snapshot: %s", err)
+	}
+	b.Container.SetBindRoDir(r.Path, localRepoPath)
+	return AddPacmanRepository(b.ContainerPath, r.Name, "file://"+localRepoPath)
+}
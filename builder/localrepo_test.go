@@ -0,0 +1,127 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/devtools/repo"
+	"github.com/foxboron/devtools/utils"
+)
+
+func TestAddPacmanRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacmanconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := "[options]\nArchitecture = auto\n\n[core]\nInclude = /etc/pacman.d/mirrorlist\n"
+	if err := os.MkdirAll(path.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "etc", "pacman.conf"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddPacmanRepository(dir, "local", "file:///repo"); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path.Join(dir, "etc", "pacman.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[options]\nArchitecture = auto\n\n[local]\nSigLevel = Optional TrustAll\nServer = file:///repo\n\n[core]\nInclude = /etc/pacman.d/mirrorlist\n"
+	if string(buf) != expected {
+		t.Errorf("unexpected pacman.conf:\n%s", buf)
+	}
+}
+
+func TestLocalRepo(t *testing.T) {
+	b, _, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+	downloadSources = func(*Builder) error { return nil }
+	defer func() { downloadSources = DownloadSources }()
+
+	local, err := NewSessionRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Remove()
+	var added []string
+	repoAdd = func(db string, removeOld, preventDowngrade bool, files ...string) error {
+		added = append(added, files...)
+		return ioutil.WriteFile(db, []byte("db"), 0644)
+	}
+	defer func() { repoAdd = repo.RepoAdd }()
+	b.LocalRepo = local
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Fork("first"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := b.ContainerPath
+	if _, err := os.Stat(path.Join(snapshot, "var/lib/pacman/sync", LocalRepoName+".db")); !os.IsNotExist(err) {
+		t.Error("an empty local repository should not be set up")
+	}
+	c.ExecFunc = func(command string) error {
+		if strings.HasSuffix(command, makepkgArgs) {
+			for _, dest := range []string{"logdest", "srcpkgdest"} {
+				if err := os.MkdirAll(path.Join(c.GetPath(), dest), 0755); err != nil {
+					return err
+				}
+			}
+			if err := createFile(path.Join(c.GetPath(), "pkgdest", "foo-1-1-any.pkg.tar.zst")); err != nil {
+				return err
+			}
+			return createFile(path.Join(c.GetPath(), "pkgdest", "foo-1-1-any.pkg.tar.zst.sig"))
+		}
+		return nil
+	}
+	if _, err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Destroy("first"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{path.Join(local.Path, "foo-1-1-any.pkg.tar.zst")}
+	if !reflect.DeepEqual(added, expected) {
+		t.Errorf("expected %v to be added, got %v", expected, added)
+	}
+
+	// The fake backend does not carry the root over into snapshots
+	conf := path.Join(path.Dir(b.Path), "second", containerPacmanConf)
+	if err := os.MkdirAll(path.Dir(conf), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.CopyFile(b.PacmanConf, conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Fork("second"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot = b.ContainerPath
+	if _, err := os.Stat(path.Join(snapshot, "var/lib/pacman/sync", LocalRepoName+".db")); err != nil {
+		t.Errorf("local database was not copied into the snapshot: %s", err)
+	}
+	buf, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), "["+LocalRepoName+"]\nSigLevel = Optional TrustAll\nServer = file://"+localRepoPath) {
+		t.Errorf("local repository is not in pacman.conf:\n%s", buf)
+	}
+	if c.BindRoDirs[local.Path] != localRepoPath {
+		t.Errorf("local repository is not bound: %v", c.BindRoDirs)
+	}
+
+	if err := local.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(local.Path); !os.IsNotExist(err) {
+		t.Error("session repository was not removed")
+	}
+}
@@ -0,0 +1,21 @@
+package builder
+
+import (
+	"os"
+	"path"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+// RootLock is a flock(2) on <root>.lock. It is held exclusively while the
+// root is changed and shared while snapshots of it are in use, other builds
+// may snapshot the root then but nobody may change it.
+type RootLock = utils.FileLock
+
+// LockRoot locks root exclusively, waiting for other users of it
+func LockRoot(root string) (*RootLock, error) {
+	if err := os.MkdirAll(path.Dir(root), 0755); err != nil {
+		return nil, err
+	}
+	return utils.LockFile(root+".lock", root)
+}
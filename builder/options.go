@@ -0,0 +1,406 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/devtools/backend"
+	"github.com/foxboron/devtools/backend/fs/btrfs"
+	"github.com/foxboron/devtools/backend/fs/overlay"
+	"github.com/foxboron/devtools/bootstrap"
+	"github.com/foxboron/devtools/bootstrap/archiso"
+	"github.com/foxboron/devtools/bootstrap/oci"
+	"github.com/foxboron/devtools/bootstrap/offline"
+	"github.com/foxboron/devtools/bootstrap/pacstrap"
+	"github.com/foxboron/devtools/container"
+	"github.com/foxboron/devtools/container/nspawn"
+	"github.com/foxboron/devtools/utils"
+)
+
+// Defaults of NewBuilder
+var (
+	DefaultBackend     = "overlay"
+	DefaultContainer   = "nspawn"
+	DefaultPacmanConf  = "/etc/pacman.conf"
+	DefaultMakepkgConf = "/etc/makepkg.conf"
+)
+
+// options collects what the Option functions set before NewBuilder
+// assembles the Builder
+type options struct {
+	backend       string
+	bootstrap     string
+	container     string
+	backendImpl   backend.Backend
+	bootstrapImpl bootstrap.Bootstrap
+	containerImpl container.Container
+
+	repository   string
+	architecture string
+	pacmanConf   string
+	makepkgConf  string
+	configDirs   []string
+	noSetarch    bool
+	buildNetwork bool
+	install      []string
+	startDir     string
+	localRepo    *LocalRepo
+
+	packages       []string
+	image          string
+	imageReference string
+	keyring        string
+	packageDirs    []string
+}
+
+// Option configures a Builder created by NewBuilder
+type Option func(*options) error
+
+// WithBackendName selects the backend by name, e.g. "overlay"
+func WithBackendName(name string) Option {
+	return func(o *options) error {
+		o.backend = name
+		return nil
+	}
+}
+
+// WithBootstrapName selects the bootstrap by name, e.g. "archiso". The default
+// is pacstrap if it is installed, archiso otherwise.
+func WithBootstrapName(name string) Option {
+	return func(o *options) error {
+		o.bootstrap = name
+		return nil
+	}
+}
+
+// WithContainerName selects the container by name, e.g. "nspawn"
+func WithContainerName(name string) Option {
+	return func(o *options) error {
+		o.container = name
+		return nil
+	}
+}
+
+// WithBackendImpl uses b instead of selecting a backend by name
+func WithBackendImpl(b backend.Backend) Option {
+	return func(o *options) error {
+		o.backendImpl = b
+		return nil
+	}
+}
+
+// WithBootstrapImpl uses b instead of selecting a bootstrap by name, e.g. to
+// configure it beyond what the options cover
+func WithBootstrapImpl(b bootstrap.Bootstrap) Option {
+	return func(o *options) error {
+		o.bootstrapImpl = b
+		return nil
+	}
+}
+
+// WithContainerImpl uses c instead of selecting a container by name
+func WithContainerImpl(c container.Container) Option {
+	return func(o *options) error {
+		o.containerImpl = c
+		return nil
+	}
+}
+
+// WithRepository selects the repository to build against. Unless given, the
+// pacman.conf and makepkg.conf are the ones of the repository and
+// architecture in the config dirs.
+func WithRepository(repository string) Option {
+	return func(o *options) error {
+		o.repository = repository
+		return nil
+	}
+}
+
+// WithArchitecture sets the architecture of the root, the host architecture
+// by default
+func WithArchitecture(arch string) Option {
+	return func(o *options) error {
+		if _, err := utils.GetArchitecture(arch); err != nil {
+			return err
+		}
+		o.architecture = arch
+		return nil
+	}
+}
+
+// WithConfigDirs sets where the repository and architecture specific configs
+// are looked up, ConfigDirs by default
+func WithConfigDirs(dirs ...string) Option {
+	return func(o *options) error {
+		o.configDirs = dirs
+		return nil
+	}
+}
+
+func WithPacmanConf(path string) Option {
+	return func(o *options) error {
+		o.pacmanConf = path
+		return nil
+	}
+}
+
+func WithMakepkgConf(path string) Option {
+	return func(o *options) error {
+		o.makepkgConf = path
+		return nil
+	}
+}
+
+// WithNoSetarch skips the linux32 personality for i686 builds on x86_64
+func WithNoSetarch(noSetarch bool) Option {
+	return func(o *options) error {
+		o.noSetarch = noSetarch
+		return nil
+	}
+}
+
+// WithBuildNetwork keeps the network available during build()
+func WithBuildNetwork(buildNetwork bool) Option {
+	return func(o *options) error {
+		o.buildNetwork = buildNetwork
+		return nil
+	}
+}
+
+// WithInstallPackages installs package files into every snapshot, like
+// makechrootpkg -I
+func WithInstallPackages(files ...string) Option {
+	return func(o *options) error {
+		for _, file := range files {
+			if _, err := os.Stat(file); err != nil {
+				return fmt.Errorf("Could not find package %s", file)
+			}
+		}
+		o.install = append(o.install, files...)
+		return nil
+	}
+}
+
+// WithStartDir builds the PKGBUILD in dir instead of the working directory
+func WithStartDir(dir string) Option {
+	return func(o *options) error {
+		if _, err := os.Stat(filepath.Join(dir, "PKGBUILD")); err != nil {
+			return fmt.Errorf("Could not find a PKGBUILD in %s", dir)
+		}
+		o.startDir = dir
+		return nil
+	}
+}
+
+// WithLocalRepo adds the built packages to r and makes it available to every
+// snapshot
+func WithLocalRepo(r *LocalRepo) Option {
+	return func(o *options) error {
+		o.localRepo = r
+		return nil
+	}
+}
+
+// WithPackages sets the packages the pacstrap and offline bootstraps install
+func WithPackages(packages ...string) Option {
+	return func(o *options) error {
+		o.packages = packages
+		return nil
+	}
+}
+
+// WithImage sets the image of the oci bootstrap and the reference of the
+// image to use in it
+func WithImage(image, reference string) Option {
+	return func(o *options) error {
+		o.image = image
+		o.imageReference = reference
+		return nil
+	}
+}
+
+// WithBootstrapKeyring sets the keyring the archiso bootstrap verifies the
+// tarball with, the one of its source by default
+func WithBootstrapKeyring(keyring string) Option {
+	return func(o *options) error {
+		o.keyring = keyring
+		return nil
+	}
+}
+
+// WithPackageDirs adds package caches the pacstrap and offline bootstraps
+// install from, before the CacheDir entries of the pacman.conf
+func WithPackageDirs(dirs ...string) Option {
+	return func(o *options) error {
+		o.packageDirs = append(o.packageDirs, dirs...)
+		return nil
+	}
+}
+
+// configPath makes a config path absolute and checks it exists
+func configPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return "", fmt.Errorf("Could not find config %s", path)
+	}
+	return abs, nil
+}
+
+func newBackend(o *options, path string) (backend.Backend, error) {
+	if o.backendImpl != nil {
+		return o.backendImpl, nil
+	}
+	switch backend.GetBackend(o.backend) {
+	case backend.Overlay:
+		return overlay.NewOverlay(path), nil
+	case backend.Btrfs:
+		return btrfs.NewBtrfs(path), nil
+	}
+	return nil, fmt.Errorf("Unknown backend %q", o.backend)
+}
+
+func newBootstrap(o *options) (bootstrap.Bootstrap, error) {
+	if o.bootstrapImpl != nil {
+		return o.bootstrapImpl, nil
+	}
+	bootstrapType := bootstrap.DefaultBootstrap()
+	if o.bootstrap != "" {
+		var ok bool
+		if bootstrapType, ok = bootstrap.LookupBootstrap(o.bootstrap); !ok {
+			return nil, fmt.Errorf("Unknown bootstrap %q", o.bootstrap)
+		}
+	}
+	switch bootstrapType {
+	case bootstrap.Archiso:
+		a, err := archiso.NewArchiso(o.pacmanConf, o.architecture)
+		if err != nil {
+			return nil, err
+		}
+		if o.keyring != "" {
+			a.Keyring = o.keyring
+		}
+		return a, nil
+	case bootstrap.Pacstrap:
+		p, err := pacstrap.NewPacstrap(o.pacmanConf)
+		if err != nil {
+			return nil, err
+		}
+		if len(o.packages) != 0 {
+			p.Packages = o.packages
+		}
+		p.Cachedirs = append(o.packageDirs, p.Cachedirs...)
+		p.Architecture = o.architecture
+		return p, nil
+	case bootstrap.Offline:
+		off, err := offline.NewOffline(o.pacmanConf)
+		if err != nil {
+			return nil, err
+		}
+		if len(o.packages) != 0 {
+			off.Packages = o.packages
+		}
+		off.PackageDirs = append(o.packageDirs, off.PackageDirs...)
+		off.Architecture = o.architecture
+		return off, nil
+	case bootstrap.OCI:
+		if o.image == "" {
+			return nil, fmt.Errorf("The oci bootstrap needs an image")
+		}
+		return oci.NewOCI(o.image, o.imageReference, o.architecture), nil
+	}
+	return nil, fmt.Errorf("Unknown bootstrap %q", o.bootstrap)
+}
+
+func newContainer(o *options, path string) (container.Container, error) {
+	if o.containerImpl != nil {
+		return o.containerImpl, nil
+	}
+	switch o.container {
+	case "nspawn":
+		return nspawn.NewNspawn(path), nil
+	}
+	return nil, fmt.Errorf("Unknown container %q", o.container)
+}
+
+// NewBuilder returns a Builder for the root at path. The backend, bootstrap
+// and container are selected by name unless given with the Impl options.
+func NewBuilder(path string, opts ...Option) (*Builder, error) {
+	if path == "" {
+		return nil, fmt.Errorf("No path given for the root")
+	}
+	o := &options{
+		backend:    DefaultBackend,
+		container:  DefaultContainer,
+		configDirs: ConfigDirs,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	// Without the repository specific configs the ones of the host are used
+	if o.pacmanConf == "" {
+		o.pacmanConf = DefaultPacmanConf
+		if o.repository != "" {
+			if conf, err := RepositoryPacmanConf(o.configDirs, o.repository); err == nil {
+				o.pacmanConf = conf
+			} else {
+				utils.Warningf("%s, using %s", err, DefaultPacmanConf)
+			}
+		}
+	}
+	if o.makepkgConf == "" {
+		o.makepkgConf = DefaultMakepkgConf
+		if o.repository != "" {
+			arch := o.architecture
+			if arch == "" {
+				arch = utils.HostArchitecture()
+			}
+			if conf, err := ArchitectureMakepkgConf(o.configDirs, arch); err == nil {
+				o.makepkgConf = conf
+			} else {
+				utils.Warningf("%s, using %s", err, DefaultMakepkgConf)
+			}
+		}
+	}
+	if o.pacmanConf, err = configPath(o.pacmanConf); err != nil {
+		return nil, err
+	}
+	if o.makepkgConf, err = configPath(o.makepkgConf); err != nil {
+		return nil, err
+	}
+	if _, err := utils.GetPacmanConf(o.pacmanConf); err != nil {
+		return nil, err
+	}
+
+	b := &Builder{
+		Path:            path,
+		ContainerPath:   path,
+		Repository:      o.repository,
+		Architecture:    o.architecture,
+		PacmanConf:      o.pacmanConf,
+		MakepkgConf:     o.makepkgConf,
+		NoSetarch:       o.noSetarch,
+		BuildNetwork:    o.buildNetwork,
+		InstallPackages: o.install,
+		StartDir:        o.startDir,
+		LocalRepo:       o.localRepo,
+	}
+	if b.Backend, err = newBackend(o, path); err != nil {
+		return nil, err
+	}
+	if b.Bootstrap, err = newBootstrap(o); err != nil {
+		return nil, err
+	}
+	if b.Container, err = newContainer(o, path); err != nil {
+		return nil, err
+	}
+	_, b.Offline = b.Bootstrap.(*offline.Offline)
+	return b, nil
+}
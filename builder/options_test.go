@@ -0,0 +1,68 @@
+package builder
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestNewBuilder(t *testing.T) {
+	tb, be, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+
+	b, err := NewBuilder(tb.Path,
+		WithBackendImpl(be),
+		WithContainerImpl(c),
+		WithBootstrapImpl(tb.Bootstrap),
+		WithArchitecture("x86_64"),
+		WithRepository("extra"),
+		WithPacmanConf(tb.PacmanConf),
+		WithMakepkgConf(tb.MakepkgConf),
+		WithBuildNetwork(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Backend != be || b.Container != c || b.Bootstrap != tb.Bootstrap {
+		t.Errorf("implementations were not used")
+	}
+	if b.Path != tb.Path || b.ContainerPath != tb.Path {
+		t.Errorf("unexpected paths %s and %s", b.Path, b.ContainerPath)
+	}
+	if b.Architecture != "x86_64" || b.Repository != "extra" || !b.BuildNetwork || b.Offline {
+		t.Errorf("options were not applied: %+v", b)
+	}
+	if b.PacmanConf != tb.PacmanConf || b.MakepkgConf != tb.MakepkgConf {
+		t.Errorf("unexpected configs %s and %s", b.PacmanConf, b.MakepkgConf)
+	}
+}
+
+func TestNewBuilderErrors(t *testing.T) {
+	tb, be, c, cleanup := newTestBuilder(t)
+	defer cleanup()
+
+	configs := []Option{WithPacmanConf(tb.PacmanConf), WithMakepkgConf(tb.MakepkgConf)}
+	impls := append(configs, WithBackendImpl(be), WithContainerImpl(c))
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"backend", append(configs, WithBackendName("zfs")), "Unknown backend"},
+		{"bootstrap", append(impls, WithBootstrapName("debootstrap")), "Unknown bootstrap"},
+		{"container", append(configs, WithBootstrapImpl(tb.Bootstrap), WithContainerName("docker")), "Unknown container"},
+		{"oci", append(impls, WithBootstrapName("oci")), "needs an image"},
+		{"architecture", append(impls, WithArchitecture("sparc")), "Unsupported architecture"},
+		{"pacman.conf", append(impls, WithPacmanConf(path.Join(tb.Path, "missing.conf"))), "Could not find config"},
+		{"makepkg.conf", append(impls, WithMakepkgConf(path.Join(tb.Path, "missing.conf"))), "Could not find config"},
+	} {
+		_, err := NewBuilder(tb.Path, tc.opts...)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.expected, err)
+		}
+	}
+
+	if _, err := NewBuilder("", configs...); err == nil {
+		t.Errorf("expected an error for an empty path")
+	}
+}
@@ -0,0 +1,194 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+// Job is a build the Scheduler runs in a snapshot of its own
+type Job struct {
+	// Name of the job, its snapshot and its log
+	Name    string
+	Builder *Builder
+}
+
+// Result is the outcome of a Job
+type Result struct {
+	Job      *Job
+	Products map[string]map[string]string
+	// Log is the file the output of the job is in
+	Log      string
+	Duration time.Duration
+	Err      error
+}
+
+// Scheduler runs independent builds from the same root at once
+type Scheduler struct {
+	// Root is brought up to date before the jobs snapshot it
+	Root *Builder
+	Jobs []*Job
+	// Parallel is the number of jobs running at once
+	Parallel int
+	// LogDir gets a <name>.log for every job
+	LogDir string
+	// KeepFailed keeps the snapshots of failed jobs for inspection
+	KeepFailed bool
+}
+
+// NewScheduler returns a Scheduler running parallel jobs from root at once
+func NewScheduler(root *Builder, parallel int, logDir string) *Scheduler {
+	if parallel < 1 {
+		parallel = 1
+	}
+	return &Scheduler{
+		Root:     root,
+		Parallel: parallel,
+		LogDir:   logDir,
+	}
+}
+
+// Add queues a build with b, the name is made unique among the jobs as it
+// names the snapshot
+func (s *Scheduler) Add(name string, b *Builder) *Job {
+	unique := name
+	for i := 2; s.hasJob(unique); i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	job := &Job{Name: unique, Builder: b}
+	s.Jobs = append(s.Jobs, job)
+	return job
+}
+
+func (s *Scheduler) hasJob(name string) bool {
+	for _, job := range s.Jobs {
+		if job.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Run updates the root and runs all jobs. The root is locked exclusively
+// while it is updated and shared while the jobs run. The error is about the
+// root, errors of the jobs are in their results.
+func (s *Scheduler) Run() ([]*Result, error) {
+	lock, err := LockRoot(s.Root.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	if err := s.Root.Init(); err != nil {
+		return nil, err
+	}
+	if err := s.Root.Update(); err != nil {
+		return nil, err
+	}
+	if err := s.Root.Upgrade(); err != nil {
+		return nil, err
+	}
+	if err := lock.Share(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.LogDir, 0755); err != nil {
+		return nil, err
+	}
+
+	results := make([]*Result, len(s.Jobs))
+	slots := make(chan struct{}, s.Parallel)
+	var wg sync.WaitGroup
+	for i, job := range s.Jobs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, job *Job) {
+			defer wg.Done()
+			results[i] = s.run(job)
+			<-slots
+		}(i, job)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// run builds a job in its snapshot with the output going to its log
+func (s *Scheduler) run(job *Job) *Result {
+	start := time.Now()
+	result := &Result{Job: job, Log: path.Join(s.LogDir, job.Name+".log")}
+	defer func() {
+		result.Duration = time.Since(start)
+		if result.Err != nil {
+			utils.Errorf("Failed to build %s, see %s", job.Name, result.Log)
+		} else {
+			utils.Msg2f("Finished %s", job.Name)
+		}
+	}()
+	f, err := os.Create(result.Log)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer f.Close()
+
+	b := job.Builder
+	b.SetOutput(f)
+	utils.Msg2f("Building %s", job.Name)
+	// Jobs skip Init, their containers still need the emulator or personality
+	if err := utils.SetupArchitecture(b.Container, b.Architecture, !b.NoSetarch); err != nil {
+		result.Err = err
+		return result
+	}
+	if err := b.Snapshot(job.Name); err != nil {
+		fmt.Fprintf(f, "%s\n", err)
+		if b.ContainerPath != b.Path {
+			b.Destroy(job.Name)
+		}
+		result.Err = err
+		return result
+	}
+	result.Products, result.Err = b.Build()
+	if result.Err != nil {
+		fmt.Fprintf(f, "%s\n", result.Err)
+		if s.KeepFailed {
+			utils.Msg2f("Keeping chroot copy [%s] at %s", job.Name, b.ContainerPath)
+			return result
+		}
+	}
+	if err := b.Destroy(job.Name); err != nil && result.Err == nil {
+		result.Err = err
+	}
+	return result
+}
+
+// Failed returns the number of failed results
+func Failed(results []*Result) int {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// PrintSummary writes a line per result, e.g.
+//
+//	foo  ok      1m2s  2 files
+//	bar  failed  10s   /var/lib/buildpkg/logs/bar.log
+func PrintSummary(w io.Writer, results []*Result) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, result := range results {
+		duration := result.Duration.Round(time.Second)
+		if result.Err != nil {
+			fmt.Fprintf(tw, "%s\tfailed\t%s\t%s\n", result.Job.Name, duration, result.Log)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tok\t%s\t%d files\n", result.Job.Name, duration, len(result.Products["PKGDEST"]))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,180 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	backend "github.com/foxboron/devtools/backend/fake"
+	container "github.com/foxboron/devtools/container/fake"
+)
+
+// newJobBuilder returns a builder of the same root as root, with a backend
+// and container of its own
+func newJobBuilder(root *Builder) (*Builder, *container.Container) {
+	c := container.NewContainer(root.Path)
+	return &Builder{
+		Path:          root.Path,
+		ContainerPath: root.Path,
+		Backend:       backend.NewBackend(root.Path),
+		Container:     c,
+		Bootstrap:     root.Bootstrap,
+		PacmanConf:    root.PacmanConf,
+		MakepkgConf:   root.MakepkgConf,
+	}, c
+}
+
+func TestScheduler(t *testing.T) {
+	root, _, rootContainer, cleanup := newTestBuilder(t)
+	defer cleanup()
+	downloadSources = func(*Builder) error { return nil }
+	defer func() { downloadSources = DownloadSources }()
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	s := NewScheduler(root, 2, path.Join(path.Dir(root.Path), "logs"))
+	for _, name := range []string{"foo", "bar", "foo", "baz"} {
+		b, c := newJobBuilder(root)
+		name := name
+		c.ExecFunc = func(command string) error {
+			if !strings.HasSuffix(command, makepkgArgs) {
+				return nil
+			}
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if name == "bar" {
+				return fmt.Errorf("build failed")
+			}
+			for _, dest := range []string{"logdest", "srcpkgdest"} {
+				if err := os.MkdirAll(path.Join(c.GetPath(), dest), 0755); err != nil {
+					return err
+				}
+			}
+			return createFile(path.Join(c.GetPath(), "pkgdest", name+"-1-1-any.pkg.tar.zst"))
+		}
+		s.Add(name, b)
+	}
+
+	results, err := s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning > 2 {
+		t.Errorf("%d jobs ran at once", maxRunning)
+	}
+	var names []string
+	for _, result := range results {
+		names = append(names, result.Job.Name)
+	}
+	if strings.Join(names, " ") != "foo bar foo-2 baz" {
+		t.Errorf("unexpected jobs %v", names)
+	}
+	if Failed(results) != 1 || results[1].Err == nil {
+		t.Errorf("expected bar to fail: %v", results)
+	}
+	if _, ok := results[3].Products["PKGDEST"]["baz-1-1-any.pkg.tar.zst"]; !ok {
+		t.Errorf("baz was not built: %v", results[3].Products)
+	}
+	for _, result := range results {
+		if result.Job.Builder.ContainerPath != root.Path {
+			t.Errorf("snapshot of %s was not removed", result.Job.Name)
+		}
+		log, err := ioutil.ReadFile(result.Log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(log), makepkgArgs) {
+			t.Errorf("log of %s misses the build: %s", result.Job.Name, log)
+		}
+	}
+	log, _ := ioutil.ReadFile(results[1].Log)
+	if !strings.Contains(string(log), "build failed") {
+		t.Errorf("log of bar misses the error: %s", log)
+	}
+
+	upgrades := 0
+	for _, command := range rootContainer.Executed() {
+		if strings.HasPrefix(command, "pacman -Syu") {
+			upgrades++
+		}
+	}
+	if upgrades != 2 {
+		t.Errorf("expected the root to be upgraded on init and once for all jobs: %v", rootContainer.Executed())
+	}
+
+	var summary bytes.Buffer
+	PrintSummary(&summary, results)
+	lines := strings.Split(strings.TrimRight(summary.String(), "\n"), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[1], "failed") || !strings.Contains(lines[1], results[1].Log) {
+		t.Errorf("unexpected summary:\n%s", summary.String())
+	}
+}
+
+func TestSchedulerKeepFailed(t *testing.T) {
+	root, _, _, cleanup := newTestBuilder(t)
+	defer cleanup()
+	downloadSources = func(*Builder) error { return fmt.Errorf("no sources") }
+	defer func() { downloadSources = DownloadSources }()
+
+	s := NewScheduler(root, 1, path.Join(path.Dir(root.Path), "logs"))
+	s.KeepFailed = true
+	b, _ := newJobBuilder(root)
+	s.Add("foo", b)
+	results, err := s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err == nil {
+		t.Fatal("expected the job to fail")
+	}
+	if be := b.Backend.(*backend.Backend); be.Snapshots["foo"] == "" {
+		t.Errorf("snapshot of the failed job was removed: %v", be.Events)
+	}
+}
+
+func TestLockRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := path.Join(dir, "extra-x86_64", "root")
+
+	lock, err := LockRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		second, err := LockRoot(root)
+		if err != nil {
+			t.Error(err)
+		} else {
+			second.Unlock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("root was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	<-locked
+}
@@ -18,7 +18,7 @@ func DownloadSources(builder *Builder) error {
 	}
 	defer os.RemoveAll(builddir)
 	// var c *exec.Cmd
-	makepkgconf := path.Join(builder.ContainerPath, "etc", "makepkg.conf")
+	makepkgconf := path.Join(builder.ContainerPath, containerMakepkgConf)
 	var srcdest string
 	if srcdest = makepkg.MakepkgConf("SRCDEST"); srcdest == "" {
 		srcdest = path.Join(builder.ContainerPath, "srcdest")
@@ -33,9 +33,17 @@ func DownloadSources(builder *Builder) error {
 		fmt.Sprintf("--config=%s", makepkgconf),
 		"--verifysource",
 		"-o"}
+	startdir, err := builder.startDir()
+	if err != nil {
+		return err
+	}
 	var c *exec.Cmd
 	c = exec.Command("/usr/bin/sudo", cmdArgs...)
+	c.Dir = startdir
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
+	if builder.Output != nil {
+		c.Stdout, c.Stderr = builder.Output, builder.Output
+	}
 	return c.Run()
 }
@@ -1,97 +1,377 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/user"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 
-	"github.com/foxboron/devtools/backend"
-	"github.com/foxboron/devtools/backend/fs/overlay"
-	"github.com/foxboron/devtools/bootstrap"
-	"github.com/foxboron/devtools/bootstrap/archiso"
-	"github.com/foxboron/devtools/bootstrap/pacstrap"
 	"github.com/foxboron/devtools/builder"
-	"github.com/foxboron/devtools/container/nspawn"
+	"github.com/foxboron/devtools/config"
+	"github.com/foxboron/devtools/repo"
+	"github.com/foxboron/devtools/srcinfo"
 	"github.com/foxboron/devtools/utils"
 )
 
-// Optional values
+// Where buildpkg.conf is read from, the user config is relative to
+// config.UserConfigDir
 const (
-	BuildPath    string = "/var/lib/buildpkg"
-	Architecture        = "x86_64"
-	Repository          = "extra"
-	Backend             = "overlay"
-	Bootstrap           = "archiso"
-	PacmanConf          = "/etc/pacman.conf"
-	MakepkgConf         = "/etc/makepkg.conf"
+	SystemConfig = "/etc/devtools/buildpkg.conf"
+	UserConfig   = "devtools/buildpkg.conf"
+	EnvPrefix    = "BUILDPKG_"
 )
 
+var options = []config.Option{
+	{Key: "BUILD_PATH", Flag: "p", Default: "/var/lib/buildpkg", Usage: "Directory of the roots and snapshots"},
+	{Key: "ARCHITECTURE", Flag: "a", Default: utils.HostArchitecture(), Usage: "Architecture to build for"},
+	{Key: "REPOSITORY", Flag: "r", Default: "extra", Usage: "Repository to build for"},
+	{Key: "BACKEND", Flag: "t", Default: "overlay", Usage: "Backend of the roots"},
+	{Key: "BOOTSTRAP", Flag: "b", Default: "archiso", Usage: "Bootstrap method of the root"},
+	{Key: "CONTAINER", Flag: "c", Default: "nspawn", Usage: "Container to build in"},
+	{Key: "PACMAN_CONF", Flag: "C", Usage: "Location of a pacman config file. Defaults to pacman.conf.d/<repository>.conf or /etc/pacman.conf"},
+	{Key: "MAKEPKG_CONF", Flag: "M", Usage: "Location of a makepkg config file. Defaults to makepkg.conf.d/<architecture>.conf or /etc/makepkg.conf"},
+	{Key: "NO_SETARCH", Flag: "s", Default: "false", Usage: "Do not run setarch", Bool: true},
+	{Key: "BUILD_NETWORK", Flag: "n", Default: "false", Usage: "Allow network access during build()", Bool: true},
+	{Key: "KEEP_FAILED", Flag: "k", Default: "false", Usage: "Keep the build snapshot if the build fails", Bool: true},
+	{Key: "SHELL_FAILED", Flag: "x", Default: "false", Usage: "Open a shell in the build snapshot if the build fails", Bool: true},
+	{Key: "PARALLEL", Flag: "j", Default: "1", Usage: "Number of PKGBUILDs built at once"},
+	{Key: "LOCAL_REPO", Flag: "l", Usage: "Directory of a repository of the built packages, \"session\" for a temporary one"},
+	{Key: "INSTALL_PACKAGES", Flag: "I", Usage: "Install a package into the build snapshot, can be given multiple times", List: true},
+	{Key: "BOOTSTRAP_PACKAGES", Default: "base-devel", Usage: "Packages the pacstrap and offline bootstraps install", List: true},
+	{Key: "BOOTSTRAP_KEYRING", Usage: "Keyring to verify the bootstrap tarball with"},
+	{Key: "BOOTSTRAP_IMAGE", Usage: "OCI image layout or docker save tarball for the oci bootstrap"},
+	{Key: "BOOTSTRAP_IMAGE_REFERENCE", Usage: "Image in the OCI or docker tarball to use, e.g. archlinux:base-devel"},
+	{Key: "BOOTSTRAP_CACHE_DIRS", Usage: "Package caches the pacstrap and offline bootstraps install from", List: true},
+}
+
+// loadConfig reads the system and user config and the environment, flags
+// are applied once they are parsed. Invoked as an archbuild entrypoint, e.g.
+// extra-x86_64-build, the repository and architecture are taken from the
+// name.
+func loadConfig() (*config.Config, error) {
+	cfg := config.NewConfig(EnvPrefix, options)
+	if err := cfg.LoadFile(SystemConfig); err != nil {
+		return nil, err
+	}
+	if dir, err := config.UserConfigDir(); err == nil {
+		if err := cfg.LoadFile(path.Join(dir, UserConfig)); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.LoadEnv(); err != nil {
+		return nil, err
+	}
+	name := path.Base(os.Args[0])
+	if repo, arch, ok := builder.ParseArchbuildName(name); ok {
+		cfg.Set("REPOSITORY", repo, "command "+name)
+		cfg.Set("ARCHITECTURE", arch, "command "+name)
+	}
+	cfg.RegisterFlags(flag.CommandLine)
+	return cfg, nil
+}
+
+// build forks a snapshot named name from the root, builds in it and removes
+// it again, unless it should be kept for inspection. Errors are reported
+// here, before the snapshot is inspected.
+func build(b *builder.Builder, name string, cfg *config.Config) (map[string]map[string]string, error) {
+	lock, err := builder.LockRoot(b.Path)
+	if err != nil {
+		utils.Error(err)
+		return nil, err
+	}
+	defer lock.Unlock()
+	if err := b.Init(); err != nil {
+		utils.Error(err)
+		return nil, err
+	}
+	if err := b.Update(); err != nil {
+		utils.Error(err)
+		return nil, err
+	}
+	if err := b.Upgrade(); err != nil {
+		utils.Error(err)
+		return nil, err
+	}
+	// Other builds may snapshot the root while this one runs
+	if err := lock.Share(); err != nil {
+		utils.Error(err)
+		return nil, err
+	}
+	if err := b.Snapshot(name); err != nil {
+		utils.Error(err)
+		b.Destroy(name)
+		return nil, err
+	}
+	utils.Msg(fmt.Sprintf("Synchronizing chroot copy [%s] -> [%s]", "root", name))
+	products, err := b.Build()
+	if err != nil {
+		utils.Error(err)
+		if cfg.Bool("KEEP_FAILED") || cfg.Bool("SHELL_FAILED") {
+			utils.Msg(fmt.Sprintf("Keeping chroot copy [%s] at %s", name, b.ContainerPath))
+		}
+		if cfg.Bool("SHELL_FAILED") {
+			if err := b.Inspect(); err != nil {
+				utils.Warning(err)
+			}
+		} else if cfg.Bool("KEEP_FAILED") {
+			return nil, err
+		}
+	}
+	utils.Msg(fmt.Sprintf("Deleting chroot copy [%s]", name))
+	b.Destroy(name)
+	return products, err
+}
+
+// buildGraph parses the .SRCINFO of every directory and resolves their
+// dependencies on each other
+func buildGraph(dirs []string, arch string) (*srcinfo.Graph, error) {
+	var infos []*srcinfo.SRCINFO
+	for _, dir := range dirs {
+		info, err := srcinfo.ParseDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return srcinfo.NewGraph(infos, arch)
+}
+
+// printPackages prints what the PKGDEST products of a build are
+func printPackages(products map[string]map[string]string) {
+	var files []string
+	for filename, dest := range products["PKGDEST"] {
+		if repo.IsPackageFile(filename) {
+			files = append(files, dest)
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+	sort.Strings(files)
+	utils.Msg("Built packages")
+	for _, file := range files {
+		a, err := repo.ReadArchive(file)
+		if err != nil {
+			utils.Warning(err)
+			continue
+		}
+		p := a.Package
+		utils.Msg2f("%s %s (%s): %s, %s installed, %d files", p.Name, p.Version, p.Arch,
+			utils.FormatBytes(p.CSize), utils.FormatBytes(p.ISize), len(p.Files))
+		if len(p.Depends) != 0 {
+			utils.Msg2f("  depends: %s", strings.Join(p.Depends, " "))
+		}
+		if a.BuildInfo == nil {
+			utils.Warningf("%s has no .BUILDINFO", path.Base(file))
+		}
+	}
+}
+
+// localRepo returns the repository LOCAL_REPO asks for, a temporary one for
+// "session". Builds of several PKGBUILDs always get one, they depend on each
+// other through it.
+func localRepo(cfg *config.Config, directories bool) (*builder.LocalRepo, error) {
+	switch value := cfg.Get("LOCAL_REPO"); {
+	case value == "session", value == "" && directories:
+		return builder.NewSessionRepo()
+	case value == "":
+		return nil, nil
+	default:
+		return builder.NewLocalRepo(value)
+	}
+}
+
 func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		utils.Error(err)
+		os.Exit(1)
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [config | directory...]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  config\tPrint the effective configuration and where each value is from\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  directory\tBuild the PKGBUILDs in the directories in the order of their .SRCINFO dependencies\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.Arg(0) == "config" {
+		cfg.Print(os.Stdout)
+		os.Exit(0)
+	}
+
 	if usr, _ := user.Current(); usr.Uid != "0" {
 		utils.Error("Need to be run as sudo")
 		os.Exit(1)
 	}
 
 	// Define the path all our container should fork from
-	rootBuildPath := path.Join(BuildPath, "root")
+	// Every repository and architecture has its own root
+	rootBuildPath := builder.RootPath(cfg.Get("BUILD_PATH"), cfg.Get("REPOSITORY"), cfg.Get("ARCHITECTURE"))
 
-	var backendInit backend.Backend
-	switch backend.GetBackend(Backend) {
-	case backend.Overlay:
-		backendInit = overlay.NewOverlay(rootBuildPath)
-	default:
-		utils.Error("Invalid filesystem")
-		os.Exit(1)
+	// Configs of the user take precedence over the ones we ship
+	configDirs := builder.ConfigDirs
+	if dir, err := config.UserConfigDir(); err == nil {
+		configDirs = append([]string{path.Join(dir, "devtools")}, configDirs...)
 	}
 
-	var bootstrapInit bootstrap.Bootstrap
-	switch bootstrap.GetBootstrap(Bootstrap) {
-	case bootstrap.Archiso:
-		bootstrapInit = archiso.NewArchiso(PacmanConf)
-	case bootstrap.Pacstrap:
-		bootstrapInit = pacstrap.NewPacstrap(PacmanConf)
+	opts := []builder.Option{
+		builder.WithBackendName(cfg.Get("BACKEND")),
+		builder.WithBootstrapName(cfg.Get("BOOTSTRAP")),
+		builder.WithContainerName(cfg.Get("CONTAINER")),
+		builder.WithRepository(cfg.Get("REPOSITORY")),
+		builder.WithConfigDirs(configDirs...),
+		builder.WithArchitecture(cfg.Get("ARCHITECTURE")),
+		builder.WithPacmanConf(cfg.Get("PACMAN_CONF")),
+		builder.WithMakepkgConf(cfg.Get("MAKEPKG_CONF")),
+		builder.WithNoSetarch(cfg.Bool("NO_SETARCH")),
+		builder.WithBuildNetwork(cfg.Bool("BUILD_NETWORK")),
+		builder.WithInstallPackages(cfg.List("INSTALL_PACKAGES")...),
+		builder.WithPackages(cfg.List("BOOTSTRAP_PACKAGES")...),
+		builder.WithBootstrapKeyring(cfg.Get("BOOTSTRAP_KEYRING")),
+		builder.WithImage(cfg.Get("BOOTSTRAP_IMAGE"), cfg.Get("BOOTSTRAP_IMAGE_REFERENCE")),
+		builder.WithPackageDirs(cfg.List("BOOTSTRAP_CACHE_DIRS")...),
 	}
 
-	build := &builder.Builder{
-		Path:         rootBuildPath,
-		Backend:      backendInit,
-		Bootstrap:    bootstrapInit,
-		Container:    nspawn.NewNspawn(rootBuildPath),
-		Repository:   Repository,
-		Architecture: Architecture,
-		MakepkgConf:  MakepkgConf,
-		PacmanConf:   PacmanConf,
+	containerName := os.Getenv("SUDO_USER")
+	if containerName == "" {
+		log.Fatal("Couldn't get USER name!")
 	}
 
-	err := build.Init()
+	local, err := localRepo(cfg, flag.NArg() != 0)
+	if err != nil {
+		utils.Error(err)
+		os.Exit(1)
+	}
+	if local != nil {
+		opts = append(opts, builder.WithLocalRepo(local))
+	}
+
+	var code int
+	if flag.NArg() == 0 {
+		code = buildCurrent(rootBuildPath, opts, containerName, cfg)
+	} else {
+		code = buildDirectories(flag.Args(), rootBuildPath, opts, containerName, cfg)
+	}
+	if local != nil {
+		if err := local.Remove(); err != nil {
+			utils.Warning(err)
+		}
+	}
+	os.Exit(code)
+}
+
+// buildCurrent builds the PKGBUILD in the working directory. It returns the
+// exit code.
+func buildCurrent(rootBuildPath string, opts []builder.Option, name string, cfg *config.Config) int {
+	b, err := builder.NewBuilder(rootBuildPath, opts...)
 	if err != nil {
-		log.Fatal(err)
+		utils.Error(err)
+		return 1
 	}
-	err = build.Update()
+	products, err := build(b, name, cfg)
 	if err != nil {
-		log.Fatal(err)
+		return 1
 	}
+	printPackages(products)
+	return 0
+}
 
-	containerName := os.Getenv("SUDO_USER")
-	if containerName == "" {
-		log.Fatal("Couldn't get USER name!")
+// buildDirectories builds the PKGBUILDs in dirs, dependencies first. It
+// returns the exit code.
+func buildDirectories(dirs []string, rootBuildPath string, opts []builder.Option, name string, cfg *config.Config) int {
+	graph, err := buildGraph(dirs, cfg.Get("ARCHITECTURE"))
+	if err != nil {
+		utils.Error(err)
+		return 1
+	}
+	parallel, err := strconv.Atoi(cfg.Get("PARALLEL"))
+	if err != nil || parallel < 1 {
+		utils.Errorf("Invalid PARALLEL %q", cfg.Get("PARALLEL"))
+		return 1
+	}
+	if parallel > 1 {
+		return buildParallel(graph, rootBuildPath, opts, name, parallel, cfg)
 	}
 
-	err = build.Fork(containerName)
+	order, err := graph.Order()
 	if err != nil {
-		build.Destroy(containerName)
-		log.Fatal(err)
+		utils.Error(err)
+		return 1
 	}
-	utils.Msg(fmt.Sprintf("Synchronizing chroot copy [%s] -> [%s]", "root", containerName))
-	// build.SetEnv(*Environment)
-	_, err = build.Build()
+	for i, info := range order {
+		utils.Msg(fmt.Sprintf("Building %s %s (%d/%d)", info.Base, info.Version(), i+1, len(order)))
+		b, err := builder.NewBuilder(rootBuildPath, append(opts, builder.WithStartDir(info.Dir))...)
+		if err != nil {
+			utils.Error(err)
+			return 1
+		}
+		products, err := build(b, name, cfg)
+		if err != nil {
+			utils.Error(fmt.Sprintf("Could not build %s, stopping", info.Base))
+			return 1
+		}
+		printPackages(products)
+	}
+	return 0
+}
+
+// buildParallel builds the PKGBUILDs of graph level by level, with up to
+// parallel builds of a level at once. It returns the exit code.
+func buildParallel(graph *srcinfo.Graph, rootBuildPath string, opts []builder.Option, name string, parallel int, cfg *config.Config) int {
+	levels, err := graph.Levels()
+	if err != nil {
+		utils.Error(err)
+		return 1
+	}
+	root, err := builder.NewBuilder(rootBuildPath, opts...)
 	if err != nil {
-		log.Fatal(err)
+		utils.Error(err)
+		return 1
+	}
+	if cfg.Bool("SHELL_FAILED") {
+		utils.Warning("Parallel builds do not open shells, failed snapshots are kept instead")
+	}
+	logDir := path.Join(path.Dir(rootBuildPath), "logs")
+
+	var results []*builder.Result
+	for i, level := range levels {
+		utils.Msg(fmt.Sprintf("Building %d packages (%d/%d)", len(level), i+1, len(levels)))
+		s := builder.NewScheduler(root, parallel, logDir)
+		s.KeepFailed = cfg.Bool("KEEP_FAILED") || cfg.Bool("SHELL_FAILED")
+		for _, info := range level {
+			b, err := builder.NewBuilder(rootBuildPath, append(opts, builder.WithStartDir(info.Dir))...)
+			if err != nil {
+				utils.Error(err)
+				return 1
+			}
+			s.Add(name+"-"+info.Base, b)
+		}
+		levelResults, err := s.Run()
+		if err != nil {
+			utils.Error(err)
+			return 1
+		}
+		results = append(results, levelResults...)
+		// Later levels depend on this one
+		if builder.Failed(levelResults) != 0 {
+			break
+		}
+	}
+	for _, result := range results {
+		if result.Err == nil {
+			printPackages(result.Products)
+		}
+	}
+	utils.Msg("Summary")
+	builder.PrintSummary(os.Stdout, results)
+	if builder.Failed(results) != 0 {
+		return 1
 	}
-	utils.Msg(fmt.Sprintf("Deleting chroot copy [%s]", containerName))
-	build.Destroy(containerName)
-	os.Exit(0)
-	return
+	return 0
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/foxboron/devtools/builder"
+	"github.com/foxboron/devtools/container/nspawn"
+	"github.com/foxboron/devtools/utils"
+)
+
+var (
+	PacmanConf  = flag.String("C", "/etc/pacman.conf", "Location of a pacman config file")
+	MakepkgConf = flag.String("M", "/etc/makepkg.conf", "Location of a makepkg config file")
+	Arch        = flag.String("a", "", "Architecture of the chroot, read from its pacman.conf by default")
+	NoSetarch   = flag.Bool("s", false, "Do not run setarch")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <path> [command...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if os.Geteuid() != 0 {
+		utils.Error("This script must be run as root.")
+		os.Exit(1)
+	}
+
+	if flag.NArg() < 1 {
+		utils.Error("You must specify a directory.")
+		os.Exit(1)
+	}
+
+	WorkingDir := flag.Args()[0]
+	if _, err := os.Stat(path.Join(WorkingDir, ".arch-chroot")); os.IsNotExist(err) {
+		utils.Errorf("%s is not a chroot", WorkingDir)
+		os.Exit(1)
+	}
+
+	// Read the architecture before the host pacman.conf replaces the chroot's
+	arch := *Arch
+	if arch == "" {
+		var err error
+		if arch, err = builder.PacmanArchitecture(WorkingDir); err != nil {
+			utils.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	if err := builder.SetupConfig(WorkingDir, *PacmanConf, *MakepkgConf); err != nil {
+		utils.Error(err)
+		os.Exit(1)
+	}
+	if err := builder.SetPacmanArchitecture(WorkingDir, arch); err != nil {
+		utils.Error(err)
+		os.Exit(1)
+	}
+
+	container := nspawn.NewNspawn(WorkingDir)
+	if err := utils.SetupArchitecture(container, arch, !*NoSetarch); err != nil {
+		utils.Error(err)
+		os.Exit(1)
+	}
+	if err := utils.SetupCacheDirs(container, *PacmanConf); err != nil {
+		utils.Error(err)
+		os.Exit(1)
+	}
+
+	if err := container.Shell(flag.Args()[1:]...); err != nil {
+		utils.Error(err)
+		os.Exit(1)
+	}
+}
@@ -5,13 +5,11 @@ import (
 	"log"
 	"os"
 
-	"github.com/foxboron/devtools/backend"
-	"github.com/foxboron/devtools/backend/fs/overlay"
 	"github.com/foxboron/devtools/bootstrap"
 	"github.com/foxboron/devtools/bootstrap/archiso"
+	"github.com/foxboron/devtools/bootstrap/offline"
 	"github.com/foxboron/devtools/bootstrap/pacstrap"
 	"github.com/foxboron/devtools/builder"
-	"github.com/foxboron/devtools/container/nspawn"
 	"github.com/foxboron/devtools/utils"
 )
 
@@ -27,57 +25,90 @@ func (i *listString) Set(value string) error {
 }
 
 var (
-	CopyFiles     listString
-	BootstrapType = flag.String("b", "archiso", "Bootstrap method. One of:")
-	PacmanCache   = flag.String("c", "/var/cache/pacman/pkg", "Set pacman cache")
-	BackendType   = flag.String("t", "overlay", "Backend type. One of:")
-	Help          = flag.Bool("h", false, "This message")
-	SetArch       = flag.Bool("s", true, "Do not run setarch")
-	PacmanConf    = flag.String("C", "/etc/pacman.conf", "Location of a pacman config file")
-	MakepkgConf   = flag.String("M", "/etc/makepkg.conf", "Location of a makepkg config file")
+	CopyFiles      listString
+	HookDirs       listString
+	BootstrapType  = flag.String("b", "archiso", "Bootstrap method. One of:")
+	PacmanCache    = flag.String("c", "/var/cache/pacman/pkg", "Set pacman cache")
+	BackendType    = flag.String("t", "overlay", "Backend type. One of: overlay, btrfs")
+	Help           = flag.Bool("h", false, "This message")
+	NoSetarch      = flag.Bool("s", false, "Do not run setarch")
+	Architecture   = flag.String("a", "", "Architecture of the chroot. Defaults to the host")
+	Keyring        = flag.String("k", "", "Keyring to verify the bootstrap tarball with. Defaults to the one of its source")
+	Release        = flag.String("V", "", "Bootstrap release to use, e.g. 2020.01.01. Defaults to the newest")
+	Image          = flag.String("i", "", "OCI image layout or docker save tarball for the oci bootstrap")
+	ImageReference = flag.String("r", "", "Image in the OCI or docker tarball to use, e.g. archlinux:base-devel")
+	PacmanConf     = flag.String("C", "/etc/pacman.conf", "Location of a pacman config file")
+	MakepkgConf    = flag.String("M", "/etc/makepkg.conf", "Location of a makepkg config file")
+	NoScriptlet    = flag.Bool("N", false, "Do not run install scriptlets with the pacstrap bootstrap")
 )
 
 func main() {
 	flag.Var(&CopyFiles, "f", "Copy file from the host to the chroot")
+	flag.Var(&HookDirs, "H", "Additional pacman hook directory for the pacstrap bootstrap")
 
 	flag.Usage = func() {
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
+	if os.Geteuid() != 0 {
+		utils.Error("This script must be run as root.")
+		os.Exit(1)
+	}
+
 	if flag.NArg() < 2 {
 		panic("You must specify a directory and one or more packages.")
 	}
 
 	WorkingDir := flag.Args()[0]
-	// Packages := flag.Args()[1:]
+	Packages := flag.Args()[1:]
 
-	var backendInit backend.Backend
-	switch backend.GetBackend(*BackendType) {
-	case backend.Overlay:
-		backendInit = overlay.NewOverlay(WorkingDir)
-	default:
-		utils.Error("Invalid filesystem")
-		os.Exit(1)
+	opts := []builder.Option{
+		builder.WithBackendName(*BackendType),
+		builder.WithBootstrapName(*BootstrapType),
+		builder.WithArchitecture(*Architecture),
+		builder.WithNoSetarch(*NoSetarch),
+		builder.WithPacmanConf(*PacmanConf),
+		builder.WithMakepkgConf(*MakepkgConf),
+		builder.WithPackages(Packages...),
+		builder.WithImage(*Image, *ImageReference),
 	}
-	var bootstrapInit bootstrap.Bootstrap
+	// Bootstraps with options beyond what the builder covers
 	switch bootstrap.GetBootstrap(*BootstrapType) {
 	case bootstrap.Archiso:
-		bootstrapInit = archiso.NewArchiso(string(*PacmanConf))
+		a, err := archiso.NewArchiso(*PacmanConf, *Architecture)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.Keyring = *Keyring
+		a.Version = *Release
+		opts = append(opts, builder.WithBootstrapImpl(a))
 	case bootstrap.Pacstrap:
-		bootstrapInit = pacstrap.NewPacstrap(string(*PacmanConf))
+		p, err := pacstrap.NewPacstrap(*PacmanConf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.Packages = Packages
+		p.HookDirs = HookDirs
+		p.NoScriptlet = *NoScriptlet
+		p.Cachedirs = append([]string{*PacmanCache}, p.Cachedirs...)
+		opts = append(opts, builder.WithBootstrapImpl(p))
+	case bootstrap.Offline:
+		o, err := offline.NewOffline(*PacmanConf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.PackageDirs = append([]string{*PacmanCache}, o.PackageDirs...)
+		o.Packages = Packages
+		opts = append(opts, builder.WithBootstrapImpl(o))
 	}
 
-	build := &builder.Builder{
-		Path:        WorkingDir,
-		Backend:     backendInit,
-		Bootstrap:   bootstrapInit,
-		Container:   nspawn.NewNspawn(WorkingDir),
-		MakepkgConf: string(*MakepkgConf),
-		PacmanConf:  string(*PacmanConf),
-	}
-	err := build.Init()
+	build, err := builder.NewBuilder(WorkingDir, opts...)
 	if err != nil {
+		utils.Error(err)
+		os.Exit(1)
+	}
+	if err := build.Init(); err != nil {
 		log.Fatal(err)
 	}
 	utils.Msgf("Created arch chroot at %s", WorkingDir)
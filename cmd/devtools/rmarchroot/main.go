@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/foxboron/devtools/backend"
+	"github.com/foxboron/devtools/backend/fs/btrfs"
 	"github.com/foxboron/devtools/backend/fs/overlay"
 	"github.com/foxboron/devtools/utils"
 )
@@ -30,6 +31,8 @@ func main() {
 	switch backendFs {
 	case backend.Overlay:
 		backendInit = overlay.NewOverlay(WorkingDir)
+	case backend.Btrfs:
+		backendInit = btrfs.NewBtrfs(WorkingDir)
 	default:
 		utils.Error("Invalid filesystem")
 		os.Exit(1)
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Sources of values which aren't files
+const (
+	SourceDefault = "default"
+	sourceEnv     = "environment"
+	sourceFlag    = "flag"
+)
+
+// Option is a setting which can be given in a config file as KEY=value, in
+// the environment as EnvPrefix+KEY and as a command line flag
+type Option struct {
+	Key     string
+	Flag    string
+	Default string
+	Usage   string
+	Bool    bool
+	// List values are separated by spaces, the flag can be given several
+	// times
+	List bool
+}
+
+// Value is the effective value of an option and where it came from
+type Value struct {
+	Value  string
+	Source string
+}
+
+// Config holds the values of a set of options. Files, the environment and
+// flags are applied in the order they are loaded, later ones win.
+type Config struct {
+	Options   []Option
+	EnvPrefix string
+	Values    map[string]Value
+}
+
+// NewConfig returns a config with the defaults of the options
+func NewConfig(envPrefix string, options []Option) *Config {
+	c := &Config{
+		Options:   options,
+		EnvPrefix: envPrefix,
+		Values:    make(map[string]Value),
+	}
+	for _, option := range options {
+		c.Values[option.Key] = Value{option.Default, SourceDefault}
+	}
+	return c
+}
+
+func (c *Config) option(key string) (Option, bool) {
+	for _, option := range c.Options {
+		if option.Key == key {
+			return option, true
+		}
+	}
+	return Option{}, false
+}
+
+// Set changes the value of an option, bool options have to be valid bools
+func (c *Config) Set(key, value, source string) error {
+	option, ok := c.option(key)
+	if !ok {
+		return fmt.Errorf("Unknown option %s", key)
+	}
+	if option.Bool {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid value %q for %s, expected true or false", value, key)
+		}
+		value = strconv.FormatBool(b)
+	}
+	c.Values[key] = Value{value, source}
+	return nil
+}
+
+func (c *Config) Get(key string) string {
+	return c.Values[key].Value
+}
+
+func (c *Config) Bool(key string) bool {
+	b, _ := strconv.ParseBool(c.Values[key].Value)
+	return b
+}
+
+// List returns the space separated values of an option
+func (c *Config) List(key string) []string {
+	return strings.Fields(c.Values[key].Value)
+}
+
+// LoadFile reads KEY=value lines from a file. Values can be quoted, lines
+// starting with # are comments. Missing files are skipped.
+func (c *Config) LoadFile(filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("%s:%d: expected KEY=value", filename, lineno)
+		}
+		key, value := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) > 1 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		if err := c.Set(key, value, filename); err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// LoadEnv applies the EnvPrefix+KEY environment variables which are set
+func (c *Config) LoadEnv() error {
+	for _, option := range c.Options {
+		name := c.EnvPrefix + option.Key
+		if value, ok := os.LookupEnv(name); ok {
+			if err := c.Set(option.Key, value, sourceEnv+" "+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flagValue sets an option when its flag is given
+type flagValue struct {
+	c      *Config
+	option Option
+}
+
+func (f *flagValue) String() string {
+	if f.c == nil {
+		return ""
+	}
+	return f.c.Get(f.option.Key)
+}
+
+func (f *flagValue) Set(value string) error {
+	source := sourceFlag + " -" + f.option.Flag
+	// Repeated list flags add up, they only replace values of other sources
+	if current := f.c.Values[f.option.Key]; f.option.List && current.Source == source {
+		value = current.Value + " " + value
+	}
+	return f.c.Set(f.option.Key, value, source)
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.option.Bool
+}
+
+// RegisterFlags adds the options with a Flag to fs. Flags are applied when fs
+// is parsed, so LoadFile and LoadEnv have to come first.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	for _, option := range c.Options {
+		if option.Flag == "" {
+			continue
+		}
+		fs.Var(&flagValue{c, option}, option.Flag, option.Usage)
+	}
+}
+
+// Print writes the effective configuration as a config file, with the source
+// of every value as comment
+func (c *Config) Print(w io.Writer) {
+	for _, option := range c.Options {
+		value := c.Values[option.Key]
+		fmt.Fprintf(w, "%s=%s # %s\n", option.Key, strconv.Quote(value.Value), value.Source)
+	}
+}
+
+// UserConfigDir returns $XDG_CONFIG_HOME, or ~/.config of the user running
+// sudo or of the current user
+func UserConfigDir() (string, error) {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return xdg, nil
+	}
+	var u *user.User
+	var err error
+	if uid := os.Getenv("SUDO_UID"); uid != "" {
+		u, err = user.LookupId(uid)
+	} else {
+		u, err = user.Current()
+	}
+	if err != nil {
+		return "", err
+	}
+	return path.Join(u.HomeDir, ".config"), nil
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+var testOptions = []Option{
+	{Key: "BUILD_PATH", Flag: "p", Default: "/var/lib/buildpkg"},
+	{Key: "ARCHITECTURE", Flag: "a", Default: "x86_64"},
+	{Key: "REPOSITORY", Flag: "r", Default: "extra"},
+	{Key: "BUILD_NETWORK", Flag: "n", Default: "false", Bool: true},
+}
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	filename := path.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	system := writeConfig(t, dir, "system.conf", "# system wide\nBUILD_PATH=/srv/buildpkg\nARCHITECTURE='i686'\n\nREPOSITORY=testing\n")
+	user := writeConfig(t, dir, "user.conf", "ARCHITECTURE = \"aarch64\"\n")
+	os.Setenv("TEST_REPOSITORY", "staging")
+	defer os.Unsetenv("TEST_REPOSITORY")
+
+	c := NewConfig("TEST_", testOptions)
+	for _, filename := range []string{system, user, path.Join(dir, "missing.conf")} {
+		if err := c.LoadFile(filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.LoadEnv(); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-n", "-r", "kde-unstable"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]Value{
+		"BUILD_PATH":    {"/srv/buildpkg", system},
+		"ARCHITECTURE":  {"aarch64", user},
+		"REPOSITORY":    {"kde-unstable", "flag -r"},
+		"BUILD_NETWORK": {"true", "flag -n"},
+	}
+	for key, value := range expected {
+		if c.Values[key] != value {
+			t.Errorf("%s: expected %+v, got %+v", key, value, c.Values[key])
+		}
+	}
+	if !c.Bool("BUILD_NETWORK") {
+		t.Errorf("BUILD_NETWORK should be true")
+	}
+
+	var buf bytes.Buffer
+	c.Print(&buf)
+	if !strings.Contains(buf.String(), "REPOSITORY=\"kde-unstable\" # flag -r\n") {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestEnvSource(t *testing.T) {
+	os.Setenv("TEST_BUILD_NETWORK", "1")
+	defer os.Unsetenv("TEST_BUILD_NETWORK")
+	c := NewConfig("TEST_", testOptions)
+	if err := c.LoadEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.Values["BUILD_NETWORK"]; v.Value != "true" || v.Source != "environment TEST_BUILD_NETWORK" {
+		t.Errorf("unexpected value %+v", v)
+	}
+	if v := c.Values["BUILD_PATH"]; v.Source != SourceDefault {
+		t.Errorf("unexpected source %s", v.Source)
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	options := append(testOptions, Option{Key: "INSTALL", Flag: "I", List: true})
+	c := NewConfig("TEST_", options)
+	if err := c.Set("INSTALL", "foo", "test.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if list := c.List("INSTALL"); len(list) != 1 || list[0] != "foo" {
+		t.Errorf("unexpected list %v", list)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-I", "bar", "-I", "baz qux"}); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.Values["INSTALL"]; v.Value != "bar baz qux" || v.Source != "flag -I" {
+		t.Errorf("unexpected value %+v", v)
+	}
+	if list := c.List("INSTALL"); len(list) != 3 {
+		t.Errorf("unexpected list %v", list)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for content, expected := range map[string]string{
+		"BUILD_PATH=/srv\nBACKEND=zfs\n": "bad.conf:2: Unknown option BACKEND",
+		"BUILD_NETWORK=maybe\n":          "bad.conf:1: Invalid value \"maybe\" for BUILD_NETWORK",
+		"BUILD_PATH\n":                   "bad.conf:1: expected KEY=value",
+	} {
+		c := NewConfig("TEST_", testOptions)
+		err := c.LoadFile(writeConfig(t, dir, "bad.conf", content))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+}
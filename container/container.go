@@ -1,9 +1,15 @@
 package container
 
+import "io"
+
 type Container interface {
 	Exec(command string) error
+	Shell(args ...string) error
 	SetPath(path string)
 	GetPath() string
 	SetBindDir(src, dst string)
 	SetBindRoDir(src, dst string)
+	SetPrivateNetwork(private bool)
+	SetPersonality(personality string)
+	SetOutput(w io.Writer)
 }
@@ -0,0 +1,105 @@
+package fake
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Command is a command run in the container together with the container
+// state at the time it was run
+type Command struct {
+	Path           string
+	Command        string
+	Interactive    bool
+	PrivateNetwork bool
+	Personality    string
+}
+
+// Container is an in-memory container.Container which records everything done
+// to it instead of running anything.
+type Container struct {
+	Path           string
+	BindDirs       map[string]string
+	BindRoDirs     map[string]string
+	PrivateNetwork bool
+	Personality    string
+	Commands       []Command
+
+	// Output gets every command written to it if set
+	Output io.Writer
+
+	// ExecFunc is called for every command if set, and its error is returned
+	// from Exec and Shell
+	ExecFunc func(command string) error
+}
+
+func (c *Container) run(command string, interactive bool) error {
+	c.Commands = append(c.Commands, Command{
+		Path:           c.Path,
+		Command:        command,
+		Interactive:    interactive,
+		PrivateNetwork: c.PrivateNetwork,
+		Personality:    c.Personality,
+	})
+	if c.Output != nil {
+		fmt.Fprintln(c.Output, command)
+	}
+	if c.ExecFunc != nil {
+		return c.ExecFunc(command)
+	}
+	return nil
+}
+
+func (c *Container) Exec(command string) error {
+	return c.run(command, false)
+}
+
+func (c *Container) Shell(args ...string) error {
+	return c.run(strings.Join(args, " "), true)
+}
+
+func (c *Container) SetPath(path string) {
+	c.Path = path
+}
+
+func (c *Container) GetPath() string {
+	return c.Path
+}
+
+func (c *Container) SetBindDir(src, dst string) {
+	c.BindDirs[src] = dst
+}
+
+func (c *Container) SetBindRoDir(src, dst string) {
+	c.BindRoDirs[src] = dst
+}
+
+func (c *Container) SetPrivateNetwork(private bool) {
+	c.PrivateNetwork = private
+}
+
+func (c *Container) SetPersonality(personality string) {
+	c.Personality = personality
+}
+
+func (c *Container) SetOutput(w io.Writer) {
+	c.Output = w
+}
+
+// Executed returns the commands run in the container
+func (c *Container) Executed() []string {
+	var commands []string
+	for _, cmd := range c.Commands {
+		commands = append(commands, cmd.Command)
+	}
+	return commands
+}
+
+func NewContainer(path string) *Container {
+	return &Container{
+		Path:       path,
+		BindDirs:   make(map[string]string),
+		BindRoDirs: make(map[string]string),
+	}
+}
@@ -22,27 +22,56 @@ func init() {
 
 type Nspawn struct {
 	// Env        *environment.Environment
-	Path       string
-	BindDirs   map[string]string
-	BindRoDirs map[string]string
-	Flags      []string
+	Path           string
+	BindDirs       map[string]string
+	BindRoDirs     map[string]string
+	Flags          []string
+	PrivateNetwork bool
+	Personality    string
+	// Output of Exec, stdout and stderr of the process when nil
+	Output io.Writer
 }
 
-func (n *Nspawn) Exec(command string) error {
-	var c *exec.Cmd
+func (n *Nspawn) args() []string {
 	cmdArgs := []string{}
 	cmdArgs = append(cmdArgs, "-D", n.Path)
 	cmdArgs = append(cmdArgs, n.Flags...)
+	if n.PrivateNetwork {
+		cmdArgs = append(cmdArgs, "--private-network")
+	}
+	if n.Personality != "" {
+		cmdArgs = append(cmdArgs, "--personality="+n.Personality)
+	}
 	cmdArgs = append(cmdArgs, n.FormatBind()...)
+	return cmdArgs
+}
+
+func (n *Nspawn) Exec(command string) error {
+	var c *exec.Cmd
+	cmdArgs := n.args()
 	cmdArgs = append(cmdArgs, "/bin/sh", "-c")
 	cmdArgs = append(cmdArgs, command)
 	c = exec.Command("systemd-nspawn", cmdArgs...)
 	c.Stdout = stdout
 	c.Stderr = stderr
+	if n.Output != nil {
+		c.Stdout, c.Stderr = n.Output, n.Output
+	}
 	c.Stdin = stdin
 	return c.Run()
 }
 
+// Shell runs the command with the terminal attached, or the default shell
+// of root if no command is given.
+func (n *Nspawn) Shell(args ...string) error {
+	var c *exec.Cmd
+	cmdArgs := n.args()
+	cmdArgs = append(cmdArgs, args...)
+	c = exec.Command("systemd-nspawn", cmdArgs...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return c.Run()
+}
+
 // ExecScript - Excecute a script
 func (n *Nspawn) ExecScript(script []string) (string, error) {
 	return "", nil
@@ -80,6 +109,21 @@ func (n *Nspawn) SetBindRoDir(src, dst string) {
 	n.BindRoDirs[src] = dst
 }
 
+// SetPrivateNetwork disconnects the container from the host network
+func (n *Nspawn) SetPrivateNetwork(private bool) {
+	n.PrivateNetwork = private
+}
+
+// SetPersonality sets the architecture reported by uname(2) in the container
+func (n *Nspawn) SetPersonality(personality string) {
+	n.Personality = personality
+}
+
+// SetOutput redirects the output of Exec, e.g. to the log of a build
+func (n *Nspawn) SetOutput(w io.Writer) {
+	n.Output = w
+}
+
 func (n *Nspawn) FormatBind() []string {
 	var bindList []string
 	for src, dest := range n.BindDirs {
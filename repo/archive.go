@@ -0,0 +1,291 @@
+package repo
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+// BuildInfo is the .BUILDINFO of a package, see BUILDINFO(5)
+type BuildInfo struct {
+	Format            string
+	PkgName           string
+	PkgBase           string
+	PkgVer            string
+	PkgArch           string
+	PkgBuildSHA256Sum string
+	Packager          string
+	BuildDate         int64
+	BuildDir          string
+	StartDir          string
+	BuildTool         string
+	BuildToolVer      string
+	BuildEnv          []string
+	Options           []string
+	// Installed are the packages of the build environment, name-version-arch
+	Installed []string
+}
+
+// MtreeEntry is a file in the .MTREE of a package
+type MtreeEntry struct {
+	Path string
+	// Type is file, dir or link
+	Type         string
+	Mode         os.FileMode
+	UID          int
+	GID          int
+	Size         int64
+	Time         time.Time
+	Link         string
+	MD5Digest    string
+	SHA256Digest string
+}
+
+// Archive is what a package file says about itself
+type Archive struct {
+	// Package is the .PKGINFO, with the files the package installs
+	Package *Package
+	// BuildInfo is nil for packages without a .BUILDINFO
+	BuildInfo *BuildInfo
+	Mtree     []MtreeEntry
+}
+
+// ReadArchive reads the .PKGINFO, .BUILDINFO, .MTREE and the file list of a
+// package file
+func ReadArchive(filename string) (*Archive, error) {
+	return readArchive(filename, true)
+}
+
+// parseBuildInfo reads the "key = value" lines of a .BUILDINFO into b
+func parseBuildInfo(b *BuildInfo, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, " = ", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("Invalid line %q", line)
+		}
+		key, value := split[0], split[1]
+		switch key {
+		case "format":
+			b.Format = value
+		case "pkgname":
+			b.PkgName = value
+		case "pkgbase":
+			b.PkgBase = value
+		case "pkgver":
+			b.PkgVer = value
+		case "pkgarch":
+			b.PkgArch = value
+		case "pkgbuild_sha256sum":
+			b.PkgBuildSHA256Sum = value
+		case "packager":
+			b.Packager = value
+		case "builddate":
+			if _, err := fmt.Sscan(value, &b.BuildDate); err != nil {
+				return fmt.Errorf("Invalid %s %q", key, value)
+			}
+		case "builddir":
+			b.BuildDir = value
+		case "startdir":
+			b.StartDir = value
+		case "buildtool":
+			b.BuildTool = value
+		case "buildtoolver":
+			b.BuildToolVer = value
+		case "buildenv":
+			b.BuildEnv = append(b.BuildEnv, value)
+		case "options":
+			b.Options = append(b.Options, value)
+		case "installed":
+			b.Installed = append(b.Installed, value)
+		}
+	}
+	return scanner.Err()
+}
+
+// unescapeMtree decodes the \ooo octal escapes of mtree paths
+func unescapeMtree(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// setMtreeKeyword sets a keyword=value of an mtree line on e
+func setMtreeKeyword(e *MtreeEntry, keyword, value string) error {
+	var err error
+	switch keyword {
+	case "type":
+		e.Type = value
+	case "mode":
+		var mode uint64
+		mode, err = strconv.ParseUint(value, 8, 32)
+		e.Mode = os.FileMode(mode)
+	case "uid":
+		e.UID, err = strconv.Atoi(value)
+	case "gid":
+		e.GID, err = strconv.Atoi(value)
+	case "size":
+		e.Size, err = strconv.ParseInt(value, 10, 64)
+	case "time":
+		split := strings.SplitN(value, ".", 2)
+		var sec, nsec int64
+		if sec, err = strconv.ParseInt(split[0], 10, 64); err == nil && len(split) == 2 {
+			// The fraction is of a second, not nanoseconds
+			nsec, err = strconv.ParseInt((split[1] + "000000000")[:9], 10, 64)
+		}
+		e.Time = time.Unix(sec, nsec)
+	case "link":
+		e.Link = unescapeMtree(value)
+	case "md5digest":
+		e.MD5Digest = value
+	case "sha256digest":
+		e.SHA256Digest = value
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q", keyword, value)
+	}
+	return nil
+}
+
+// parseMtree reads the gzip compressed .MTREE of a package
+func parseMtree(r io.Reader) ([]MtreeEntry, error) {
+	stream, err := utils.DecompressReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	// Keywords of /set apply to every following entry
+	defaults := make(map[string]string)
+	var entries []MtreeEntry
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "/set":
+			for _, field := range fields[1:] {
+				if split := strings.SplitN(field, "=", 2); len(split) == 2 {
+					defaults[split[0]] = split[1]
+				}
+			}
+			continue
+		case "/unset":
+			for _, field := range fields[1:] {
+				delete(defaults, field)
+			}
+			continue
+		}
+		keywords := make(map[string]string)
+		for keyword, value := range defaults {
+			keywords[keyword] = value
+		}
+		for _, field := range fields[1:] {
+			if split := strings.SplitN(field, "=", 2); len(split) == 2 {
+				keywords[split[0]] = split[1]
+			}
+		}
+		e := MtreeEntry{Path: strings.TrimPrefix(unescapeMtree(fields[0]), "./")}
+		for keyword, value := range keywords {
+			if err := setMtreeKeyword(&e, keyword, value); err != nil {
+				return nil, fmt.Errorf("%s: %s", e.Path, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// readArchive reads a package file, up to the .PKGINFO unless full is set
+func readArchive(filename string, full bool) (*Archive, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := utils.DecompressReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read package %s: %s", filename, err)
+	}
+	defer stream.Close()
+
+	a := &Archive{}
+	var files []string
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read package %s: %s", filename, err)
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		switch {
+		case name == ".PKGINFO":
+			a.Package = &Package{
+				Filename: path.Base(filename),
+				CSize:    info.Size(),
+			}
+			if err := parsePkgInfo(a.Package, tarReader); err != nil {
+				return nil, fmt.Errorf("Could not parse .PKGINFO of %s: %s", filename, err)
+			}
+			if a.Package.Name == "" || a.Package.Version == "" {
+				return nil, fmt.Errorf("%s has no pkgname or pkgver in its .PKGINFO", filename)
+			}
+			if !full {
+				return a, nil
+			}
+		case !full:
+			continue
+		case name == ".BUILDINFO":
+			a.BuildInfo = &BuildInfo{}
+			if err := parseBuildInfo(a.BuildInfo, tarReader); err != nil {
+				return nil, fmt.Errorf("Could not parse .BUILDINFO of %s: %s", filename, err)
+			}
+		case name == ".MTREE":
+			if a.Mtree, err = parseMtree(tarReader); err != nil {
+				return nil, fmt.Errorf("Could not parse .MTREE of %s: %s", filename, err)
+			}
+		case name == "" || strings.HasPrefix(name, "."):
+			// Other metadata like .INSTALL is not installed
+		default:
+			if header.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") {
+				name += "/"
+			}
+			files = append(files, name)
+		}
+	}
+	if a.Package == nil {
+		return nil, fmt.Errorf("%s is not a package, it has no .PKGINFO", filename)
+	}
+	sort.Strings(files)
+	a.Package.Files = files
+	return a, nil
+}
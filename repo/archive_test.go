@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const fooBuildInfo = `format = 2
+pkgname = foo
+pkgbase = foo-base
+pkgver = 1.0-1
+pkgarch = x86_64
+pkgbuild_sha256sum = abc
+packager = Arch Linux <arch@example.org>
+builddate = 1577836800
+builddir = /build
+startdir = /startdir
+buildtool = devtools
+buildtoolver = 1:1.0.0-1-any
+buildenv = !distcc
+buildenv = color
+options = strip
+installed = glibc-2.31-1-x86_64
+installed = bash-5.0.016-1-x86_64
+`
+
+const fooMtree = `#mtree
+/set type=file uid=0 gid=0 mode=644
+./.BUILDINFO time=1577836800.0 size=100 md5digest=aa sha256digest=bb
+./usr time=1577836800.0 mode=755 type=dir
+./usr/bin/foo\040bar time=1577836800.5 mode=755 size=3 md5digest=cc sha256digest=dd
+/unset mode
+./usr/lib/libfoo.so time=1577836800.0 type=link link=libfoo.so.1
+`
+
+func TestReadArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mtree bytes.Buffer
+	gw := gzip.NewWriter(&mtree)
+	gw.Write([]byte(fooMtree))
+	gw.Close()
+	filename := path.Join(dir, "foo-1.0-1-x86_64.pkg.tar.zst")
+	writePackage(t, filename, fooPkgInfo, map[string]string{
+		".BUILDINFO":          fooBuildInfo,
+		".MTREE":              mtree.String(),
+		".INSTALL":            "post_install() { :; }\n",
+		"usr/bin/foo bar":     "foo",
+		"usr/lib/libfoo.so.1": "lib",
+	})
+
+	a, err := ReadArchive(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Package.Name != "foo" || a.Package.ISize != 2048 || a.Package.BuildDate != 1577836800 {
+		t.Errorf("unexpected package %+v", a.Package)
+	}
+	if !reflect.DeepEqual(a.Package.Files, []string{"usr/bin/foo bar", "usr/lib/libfoo.so.1"}) {
+		t.Errorf("unexpected files %v", a.Package.Files)
+	}
+
+	b := a.BuildInfo
+	if b == nil {
+		t.Fatal("missing .BUILDINFO")
+	}
+	if b.Format != "2" || b.PkgName != "foo" || b.PkgArch != "x86_64" || b.BuildDate != 1577836800 || b.BuildToolVer != "1:1.0.0-1-any" {
+		t.Errorf("unexpected .BUILDINFO %+v", b)
+	}
+	if !reflect.DeepEqual(b.BuildEnv, []string{"!distcc", "color"}) || !reflect.DeepEqual(b.Installed, []string{"glibc-2.31-1-x86_64", "bash-5.0.016-1-x86_64"}) {
+		t.Errorf("unexpected .BUILDINFO lists %+v", b)
+	}
+
+	if len(a.Mtree) != 4 {
+		t.Fatalf("expected 4 .MTREE entries, got %+v", a.Mtree)
+	}
+	foo := a.Mtree[2]
+	expected := MtreeEntry{
+		Path:         "usr/bin/foo bar",
+		Type:         "file",
+		Mode:         0755,
+		Size:         3,
+		Time:         time.Unix(1577836800, 500000000),
+		MD5Digest:    "cc",
+		SHA256Digest: "dd",
+	}
+	if !reflect.DeepEqual(foo, expected) {
+		t.Errorf("unexpected entry %+v", foo)
+	}
+	if dir := a.Mtree[1]; dir.Type != "dir" || dir.Mode != 0755 {
+		t.Errorf("unexpected entry %+v", dir)
+	}
+	if link := a.Mtree[3]; link.Type != "link" || link.Link != "libfoo.so.1" || link.Mode != 0 {
+		t.Errorf("unexpected entry %+v", link)
+	}
+}
+
+func TestReadArchiveWithoutMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "bar-2-1-any.pkg.tar.zst")
+	writePackage(t, filename, barPkgInfo, nil)
+
+	a, err := ReadArchive(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.BuildInfo != nil || a.Mtree != nil || a.Package.Files != nil {
+		t.Errorf("unexpected metadata %+v", a)
+	}
+}
@@ -0,0 +1,189 @@
+package repo
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+// Package is an entry of a repository database, as written by repo-add
+type Package struct {
+	Filename     string
+	Name         string
+	Base         string
+	Version      string
+	Desc         string
+	Groups       []string
+	CSize        int64
+	ISize        int64
+	MD5Sum       string
+	SHA256Sum    string
+	PGPSig       string
+	URL          string
+	License      []string
+	Arch         string
+	BuildDate    int64
+	Packager     string
+	Replaces     []string
+	Conflicts    []string
+	Provides     []string
+	Depends      []string
+	OptDepends   []string
+	MakeDepends  []string
+	CheckDepends []string
+
+	// Files is only set for entries of a .files database
+	Files []string
+}
+
+// DepName returns the package name of a dependency, stripping any version
+// constraint and optdepends description
+func DepName(dep string) string {
+	if i := strings.IndexAny(dep, "<>=:"); i != -1 {
+		return dep[:i]
+	}
+	return dep
+}
+
+func (p *Package) set(key string, values []string) error {
+	value := strings.Join(values, "\n")
+	var err error
+	switch key {
+	case "FILENAME":
+		p.Filename = value
+	case "NAME":
+		p.Name = value
+	case "BASE":
+		p.Base = value
+	case "VERSION":
+		p.Version = value
+	case "DESC":
+		p.Desc = value
+	case "GROUPS":
+		p.Groups = values
+	case "CSIZE":
+		_, err = fmt.Sscan(value, &p.CSize)
+	case "ISIZE":
+		_, err = fmt.Sscan(value, &p.ISize)
+	case "MD5SUM":
+		p.MD5Sum = value
+	case "SHA256SUM":
+		p.SHA256Sum = value
+	case "PGPSIG":
+		p.PGPSig = value
+	case "URL":
+		p.URL = value
+	case "LICENSE":
+		p.License = values
+	case "ARCH":
+		p.Arch = value
+	case "BUILDDATE":
+		_, err = fmt.Sscan(value, &p.BuildDate)
+	case "PACKAGER":
+		p.Packager = value
+	case "REPLACES":
+		p.Replaces = values
+	case "CONFLICTS":
+		p.Conflicts = values
+	case "PROVIDES":
+		p.Provides = values
+	case "DEPENDS":
+		p.Depends = values
+	case "OPTDEPENDS":
+		p.OptDepends = values
+	case "MAKEDEPENDS":
+		p.MakeDepends = values
+	case "CHECKDEPENDS":
+		p.CheckDepends = values
+	case "FILES":
+		p.Files = values
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid %%%s%% %q", key, value)
+	}
+	return nil
+}
+
+// parseEntry reads a desc or files entry of a database into p
+func parseEntry(p *Package, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	var key string
+	var values []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") && len(line) > 2:
+			key = strings.Trim(line, "%")
+			values = nil
+		case line == "":
+			if key != "" {
+				if err := p.set(key, values); err != nil {
+					return err
+				}
+			}
+			key = ""
+		case key != "":
+			values = append(values, line)
+		}
+	}
+	if key != "" {
+		if err := p.set(key, values); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadDatabase reads the packages of a repository database, either a .db or
+// a .files database compressed with anything utils.DecompressReader handles
+func ReadDatabase(dbPath string) ([]*Package, error) {
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stream, err := utils.DecompressReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	entries := make(map[string]*Package)
+	var order []string
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read database %s: %s", dbPath, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		dir, file := path.Split(strings.TrimSuffix(header.Name, "/"))
+		if file != "desc" && file != "files" {
+			continue
+		}
+		entry, ok := entries[dir]
+		if !ok {
+			entry = &Package{}
+			entries[dir] = entry
+			order = append(order, dir)
+		}
+		if err := parseEntry(entry, tarReader); err != nil {
+			return nil, fmt.Errorf("Could not parse %s in %s: %s", header.Name, dbPath, err)
+		}
+	}
+	packages := make([]*Package, 0, len(order))
+	for _, dir := range order {
+		packages = append(packages, entries[dir])
+	}
+	return packages, nil
+}
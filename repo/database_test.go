@@ -0,0 +1,87 @@
+package repo
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+const bashDesc = `%FILENAME%
+bash-5.0.011-1-x86_64.pkg.tar.xz
+
+%NAME%
+bash
+
+%VERSION%
+5.0.011-1
+
+%CSIZE%
+1456904
+
+%PROVIDES%
+sh
+
+%DEPENDS%
+readline>=7.0
+glibc
+ncurses
+
+`
+
+func TestReadDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := path.Join(dir, "core.db")
+	f, err := os.Create(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "bash-5.0.011-1/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "bash-5.0.011-1/desc", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(bashDesc))})
+	tw.Write([]byte(bashDesc))
+	tw.Close()
+	gw.Close()
+	f.Close()
+
+	packages, err := ReadDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 1 {
+		t.Fatalf("expected one package, got %d", len(packages))
+	}
+	bash := packages[0]
+	if bash.Name != "bash" || bash.Version != "5.0.011-1" || bash.CSize != 1456904 {
+		t.Errorf("unexpected package %+v", bash)
+	}
+	if !reflect.DeepEqual(bash.Depends, []string{"readline>=7.0", "glibc", "ncurses"}) {
+		t.Errorf("unexpected depends %v", bash.Depends)
+	}
+	if !reflect.DeepEqual(bash.Provides, []string{"sh"}) {
+		t.Errorf("unexpected provides %v", bash.Provides)
+	}
+}
+
+func TestDepName(t *testing.T) {
+	for dep, name := range map[string]string{
+		"glibc":                "glibc",
+		"readline>=7.0":        "readline",
+		"libalpm.so=12-64":     "libalpm.so",
+		"perl<5.31":            "perl",
+		"git: for VCS sources": "git",
+	} {
+		if DepName(dep) != name {
+			t.Errorf("expected %s for %s, got %s", name, dep, DepName(dep))
+		}
+	}
+}
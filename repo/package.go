@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PackageExtensions are the extensions of the package files makepkg writes
+var PackageExtensions = []string{".pkg.tar.zst", ".pkg.tar.xz", ".pkg.tar.gz", ".pkg.tar"}
+
+// IsPackageFile reports if filename has one of PackageExtensions
+func IsPackageFile(filename string) bool {
+	for _, ext := range PackageExtensions {
+		if strings.HasSuffix(filename, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePkgInfo reads the "key = value" lines of a .PKGINFO into p
+func parsePkgInfo(p *Package, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, " = ", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("Invalid line %q", line)
+		}
+		key, value := split[0], split[1]
+		var err error
+		switch key {
+		case "pkgname":
+			p.Name = value
+		case "pkgbase":
+			p.Base = value
+		case "pkgver":
+			p.Version = value
+		case "pkgdesc":
+			p.Desc = value
+		case "url":
+			p.URL = value
+		case "builddate":
+			_, err = fmt.Sscan(value, &p.BuildDate)
+		case "packager":
+			p.Packager = value
+		case "size":
+			_, err = fmt.Sscan(value, &p.ISize)
+		case "arch":
+			p.Arch = value
+		case "license":
+			p.License = append(p.License, value)
+		case "replaces":
+			p.Replaces = append(p.Replaces, value)
+		case "group":
+			p.Groups = append(p.Groups, value)
+		case "conflict":
+			p.Conflicts = append(p.Conflicts, value)
+		case "provides":
+			p.Provides = append(p.Provides, value)
+		case "depend":
+			p.Depends = append(p.Depends, value)
+		case "optdepend":
+			p.OptDepends = append(p.OptDepends, value)
+		case "makedepend":
+			p.MakeDepends = append(p.MakeDepends, value)
+		case "checkdepend":
+			p.CheckDepends = append(p.CheckDepends, value)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid %s %q", key, value)
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadPackage reads the .PKGINFO of a package file
+func ReadPackage(filename string) (*Package, error) {
+	a, err := readArchive(filename, false)
+	if err != nil {
+		return nil, err
+	}
+	return a.Package, nil
+}
+
+// ReadPackageFiles reads the .PKGINFO of a package file along with the files
+// it installs, like a .files database has them
+func ReadPackageFiles(filename string) (*Package, error) {
+	a, err := readArchive(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	return a.Package, nil
+}
@@ -0,0 +1,121 @@
+package repo
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const fooPkgInfo = `# Generated by makepkg 5.2.1
+# using fakeroot version 1.24
+pkgname = foo
+pkgbase = foo-base
+pkgver = 1.0-1
+pkgdesc = A package = with equals
+url = https://example.org
+builddate = 1577836800
+packager = Arch Linux <arch@example.org>
+size = 2048
+arch = x86_64
+license = MIT
+license = GPL
+provides = libfoo.so=1-64
+depend = glibc
+depend = bash>=5
+optdepend = python: for scripts
+makedepend = cmake
+`
+
+// writePackage writes a zstd compressed package with the given .PKGINFO and
+// files
+func writePackage(t *testing.T, filename, pkginfo string, files map[string]string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw, err := zstd.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	write := func(name, content string) {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	if pkginfo != "" {
+		write(".PKGINFO", pkginfo)
+	}
+	for name, content := range files {
+		write(name, content)
+	}
+	tw.Close()
+	zw.Close()
+}
+
+func TestReadPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "foo-1.0-1-x86_64.pkg.tar.zst")
+	writePackage(t, filename, fooPkgInfo, map[string]string{"usr/bin/foo": "#!/bin/sh\n"})
+	pkg, err := ReadPackage(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(filename)
+	expected := &Package{
+		Filename:    "foo-1.0-1-x86_64.pkg.tar.zst",
+		Name:        "foo",
+		Base:        "foo-base",
+		Version:     "1.0-1",
+		Desc:        "A package = with equals",
+		URL:         "https://example.org",
+		BuildDate:   1577836800,
+		Packager:    "Arch Linux <arch@example.org>",
+		ISize:       2048,
+		CSize:       info.Size(),
+		Arch:        "x86_64",
+		License:     []string{"MIT", "GPL"},
+		Provides:    []string{"libfoo.so=1-64"},
+		Depends:     []string{"glibc", "bash>=5"},
+		OptDepends:  []string{"python: for scripts"},
+		MakeDepends: []string{"cmake"},
+	}
+	if !reflect.DeepEqual(pkg, expected) {
+		t.Errorf("expected %+v, got %+v", expected, pkg)
+	}
+
+	if !IsPackageFile(filename) || IsPackageFile(filename+".sig") {
+		t.Error("IsPackageFile does not match the package extensions")
+	}
+}
+
+func TestReadPackageInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	noInfo := path.Join(dir, "noinfo-1-1-any.pkg.tar.zst")
+	writePackage(t, noInfo, "", map[string]string{"usr/bin/foo": ""})
+	noVersion := path.Join(dir, "noversion-1-1-any.pkg.tar.zst")
+	writePackage(t, noVersion, "pkgname = noversion\n", nil)
+	garbage := path.Join(dir, "garbage-1-1-any.pkg.tar.zst")
+	ioutil.WriteFile(garbage, []byte("not a tarball"), 0644)
+
+	for _, filename := range []string{noInfo, noVersion, garbage, path.Join(dir, "missing.pkg.tar.zst")} {
+		if _, err := ReadPackage(filename); err == nil {
+			t.Errorf("%s: expected an error", path.Base(filename))
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package repo
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	openpgp "golang.org/x/crypto/openpgp"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+// Database is a repository database managed the way repo-add and repo-remove
+// do it. The .db archive has a desc entry for every package, the .files
+// archive has their files on top.
+type Database struct {
+	// Path of the .db archive, e.g. /srv/repo/local.db.tar.zst
+	Path string
+	// RemoveOld deletes the package files and signatures of replaced packages
+	// once Write succeeded
+	RemoveOld bool
+	// PreventDowngrade keeps a newer version already in the database instead
+	// of replacing it with an older one, like repo-add --prevent-downgrade
+	PreventDowngrade bool
+	// SignKey signs both archives with a detached signature if set
+	SignKey *openpgp.Entity
+
+	packages map[string]*Package
+	// replaced are the package files of replaced packages for RemoveOld
+	replaced []string
+}
+
+// splitDBPath splits a database archive name, e.g. local.db.tar.gz, into the
+// repository name and the archive extension
+func splitDBPath(dbPath string) (string, string, error) {
+	base := path.Base(dbPath)
+	i := strings.Index(base, ".db.tar")
+	if i < 1 {
+		return "", "", fmt.Errorf("%s is not a database archive like repo.db.tar.gz", dbPath)
+	}
+	return base[:i], base[i+len(".db"):], nil
+}
+
+// OpenDatabase reads the database at dbPath, it is empty if it does not
+// exist yet
+func OpenDatabase(dbPath string) (*Database, error) {
+	if _, _, err := splitDBPath(dbPath); err != nil {
+		return nil, err
+	}
+	d := &Database{Path: dbPath, packages: make(map[string]*Package)}
+	// The .files archive has everything of the .db one
+	for _, archive := range []string{d.FilesPath(), dbPath} {
+		if _, err := os.Stat(archive); os.IsNotExist(err) {
+			continue
+		}
+		packages, err := ReadDatabase(archive)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range packages {
+			d.packages[p.Name] = p
+		}
+		break
+	}
+	return d, nil
+}
+
+// FilesPath returns the .files archive next to the .db archive
+func (d *Database) FilesPath() string {
+	name, ext, _ := splitDBPath(d.Path)
+	return path.Join(path.Dir(d.Path), name+".files"+ext)
+}
+
+// Packages returns the packages in the database sorted by name
+func (d *Database) Packages() []*Package {
+	var packages []*Package
+	for _, p := range d.packages {
+		packages = append(packages, p)
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Name < packages[j].Name
+	})
+	return packages
+}
+
+// checksums returns the hex MD5 and SHA256 sums of a file
+func checksums(filename string) (string, string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	md5sum, sha256sum := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5sum, sha256sum), f); err != nil {
+		return "", "", err
+	}
+	sum := func(h hash.Hash) string { return hex.EncodeToString(h.Sum(nil)) }
+	return sum(md5sum), sum(sha256sum), nil
+}
+
+// Add adds a package file to the database, replacing any version of it
+// already there unless PreventDowngrade keeps a newer one. A signature next to it, <file>.sig, is added as well.
+func (d *Database) Add(filename string) error {
+	p, err := ReadPackageFiles(filename)
+	if err != nil {
+		return err
+	}
+	old, ok := d.packages[p.Name]
+	if ok && d.PreventDowngrade && VerCmp(old.Version, p.Version) > 0 {
+		utils.Warningf("A newer version for '%s' is already present in database", p.Name)
+		return nil
+	}
+	if p.MD5Sum, p.SHA256Sum, err = checksums(filename); err != nil {
+		return err
+	}
+	if sig, err := ioutil.ReadFile(filename + ".sig"); err == nil {
+		p.PGPSig = base64.StdEncoding.EncodeToString(sig)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if ok && d.RemoveOld && old.Filename != p.Filename {
+		d.replaced = append(d.replaced, path.Join(path.Dir(d.Path), old.Filename))
+	}
+	d.packages[p.Name] = p
+	return nil
+}
+
+// Remove removes a package from the database by name, the package file is
+// left alone
+func (d *Database) Remove(name string) error {
+	if _, ok := d.packages[name]; !ok {
+		return fmt.Errorf("%s is not in %s", name, d.Path)
+	}
+	delete(d.packages, name)
+	return nil
+}
+
+// formatEntry writes a %KEY% section of a desc or files entry, nothing for
+// empty values
+func formatEntry(w io.Writer, key string, values ...string) {
+	if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+		return
+	}
+	fmt.Fprintf(w, "%%%s%%\n", key)
+	for _, value := range values {
+		fmt.Fprintln(w, value)
+	}
+	fmt.Fprintln(w)
+}
+
+func formatInt(i int64) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.FormatInt(i, 10)
+}
+
+// writeDesc writes the desc entry of p in the order repo-add does
+func (p *Package) writeDesc(w io.Writer) {
+	formatEntry(w, "FILENAME", p.Filename)
+	formatEntry(w, "NAME", p.Name)
+	formatEntry(w, "BASE", p.Base)
+	formatEntry(w, "VERSION", p.Version)
+	formatEntry(w, "DESC", p.Desc)
+	formatEntry(w, "GROUPS", p.Groups...)
+	formatEntry(w, "CSIZE", formatInt(p.CSize))
+	formatEntry(w, "ISIZE", formatInt(p.ISize))
+	formatEntry(w, "MD5SUM", p.MD5Sum)
+	formatEntry(w, "SHA256SUM", p.SHA256Sum)
+	formatEntry(w, "PGPSIG", p.PGPSig)
+	formatEntry(w, "URL", p.URL)
+	formatEntry(w, "LICENSE", p.License...)
+	formatEntry(w, "ARCH", p.Arch)
+	formatEntry(w, "BUILDDATE", formatInt(p.BuildDate))
+	formatEntry(w, "PACKAGER", p.Packager)
+	formatEntry(w, "REPLACES", p.Replaces...)
+	formatEntry(w, "CONFLICTS", p.Conflicts...)
+	formatEntry(w, "PROVIDES", p.Provides...)
+	formatEntry(w, "DEPENDS", p.Depends...)
+	formatEntry(w, "OPTDEPENDS", p.OptDepends...)
+	formatEntry(w, "MAKEDEPENDS", p.MakeDepends...)
+	formatEntry(w, "CHECKDEPENDS", p.CheckDepends...)
+}
+
+// writeArchive writes the database to filename, with the files entries if
+// files is set. It is written next to it first and moved in place.
+func (d *Database) writeArchive(filename string, files bool) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	cw, err := utils.CompressWriter(f, filename)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	now := time.Now()
+	writeFile := func(name string, buf *bytes.Buffer) error {
+		header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(buf.Len()), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(buf.Bytes())
+		return err
+	}
+	for _, p := range d.Packages() {
+		dir := p.Name + "-" + p.Version + "/"
+		if err := tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755, ModTime: now}); err != nil {
+			return err
+		}
+		var desc bytes.Buffer
+		p.writeDesc(&desc)
+		if err := writeFile(dir+"desc", &desc); err != nil {
+			return err
+		}
+		if !files {
+			continue
+		}
+		var list bytes.Buffer
+		formatEntry(&list, "FILES", p.Files...)
+		if err := writeFile(dir+"files", &list); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// sign writes a detached signature of filename to filename.sig
+func (d *Database) sign(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sig, err := os.Create(filename + ".sig")
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+	if err := openpgp.DetachSign(sig, d.SignKey, f, nil); err != nil {
+		return fmt.Errorf("Could not sign %s: %s", filename, err)
+	}
+	return sig.Close()
+}
+
+// symlink points link at the base name of target, like the <repo>.db links
+// of repo-add
+func symlink(target, link string) error {
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(path.Base(target), link)
+}
+
+// removeReplaced deletes the files of replaced packages and their signatures,
+// unless the database still points at them
+func (d *Database) removeReplaced() error {
+	current := make(map[string]bool)
+	for _, p := range d.packages {
+		current[p.Filename] = true
+	}
+	for _, file := range d.replaced {
+		if current[path.Base(file)] {
+			continue
+		}
+		for _, f := range []string{file, file + ".sig"} {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Could not remove %s: %s", f, err)
+			}
+		}
+	}
+	d.replaced = nil
+	return nil
+}
+
+// Write writes the .db and .files archives, their signatures if SignKey is
+// set, and the <repo>.db and <repo>.files links to them. With RemoveOld the
+// files of replaced packages are deleted afterwards.
+func (d *Database) Write() error {
+	name, _, err := splitDBPath(d.Path)
+	if err != nil {
+		return err
+	}
+	dir := path.Dir(d.Path)
+	for _, archive := range []struct {
+		path, link string
+		files      bool
+	}{
+		{d.Path, path.Join(dir, name+".db"), false},
+		{d.FilesPath(), path.Join(dir, name+".files"), true},
+	} {
+		if err := d.writeArchive(archive.path, archive.files); err != nil {
+			return fmt.Errorf("Could not write %s: %s", archive.path, err)
+		}
+		if err := symlink(archive.path, archive.link); err != nil {
+			return err
+		}
+		if d.SignKey == nil {
+			// A signature of the previous archive would not match anymore
+			for _, sig := range []string{archive.path + ".sig", archive.link + ".sig"} {
+				if err := os.Remove(sig); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			continue
+		}
+		if err := d.sign(archive.path); err != nil {
+			return err
+		}
+		if err := symlink(archive.path+".sig", archive.link+".sig"); err != nil {
+			return err
+		}
+	}
+	return d.removeReplaced()
+}
+
+// RepoAdd adds package files to the database at dbPath like repo-add, with
+// removeOld like repo-add --remove and preventDowngrade like
+// --prevent-downgrade
+func RepoAdd(dbPath string, removeOld, preventDowngrade bool, files ...string) error {
+	d, err := OpenDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	d.RemoveOld = removeOld
+	d.PreventDowngrade = preventDowngrade
+	for _, file := range files {
+		if err := d.Add(file); err != nil {
+			return err
+		}
+	}
+	return d.Write()
+}
+
+// RepoRemove removes packages from the database at dbPath by name like
+// repo-remove
+func RepoRemove(dbPath string, names ...string) error {
+	d, err := OpenDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := d.Remove(name); err != nil {
+			return err
+		}
+	}
+	return d.Write()
+}
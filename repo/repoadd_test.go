@@ -0,0 +1,293 @@
+package repo
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	openpgp "golang.org/x/crypto/openpgp"
+
+	"github.com/foxboron/devtools/utils"
+)
+
+const barPkgInfo = `pkgname = bar
+pkgver = 2-1
+pkgdesc = Bar
+size = 10
+arch = any
+depend = foo
+`
+
+// readEntry returns an entry of a database archive
+func readEntry(t *testing.T, dbPath, name string) string {
+	f, err := os.Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stream, err := utils.DecompressReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(stream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if header.Name == name {
+			buf, _ := ioutil.ReadAll(tr)
+			return string(buf)
+		}
+	}
+	t.Fatalf("%s has no %s", dbPath, name)
+	return ""
+}
+
+func TestRepoAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repoadd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	foo := path.Join(dir, "foo-1.0-1-x86_64.pkg.tar.zst")
+	writePackage(t, foo, fooPkgInfo, map[string]string{
+		".BUILDINFO":     "format = 2\n",
+		"usr/bin/foo":    "foo",
+		"usr/lib/libfoo": "lib",
+	})
+	if err := ioutil.WriteFile(foo+".sig", []byte("sig"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bar := path.Join(dir, "bar-2-1-any.pkg.tar.zst")
+	writePackage(t, bar, barPkgInfo, nil)
+
+	dbPath := path.Join(dir, "local.db.tar.gz")
+	if err := RepoAdd(dbPath, false, false, foo, bar); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md5sum, sha256sum := md5.Sum(buf), sha256.Sum256(buf)
+	expected := "%FILENAME%\nfoo-1.0-1-x86_64.pkg.tar.zst\n\n" +
+		"%NAME%\nfoo\n\n" +
+		"%BASE%\nfoo-base\n\n" +
+		"%VERSION%\n1.0-1\n\n" +
+		"%DESC%\nA package = with equals\n\n" +
+		"%CSIZE%\n" + strconv.Itoa(len(buf)) + "\n\n" +
+		"%ISIZE%\n2048\n\n" +
+		"%MD5SUM%\n" + hex.EncodeToString(md5sum[:]) + "\n\n" +
+		"%SHA256SUM%\n" + hex.EncodeToString(sha256sum[:]) + "\n\n" +
+		"%PGPSIG%\nc2ln\n\n" +
+		"%URL%\nhttps://example.org\n\n" +
+		"%LICENSE%\nMIT\nGPL\n\n" +
+		"%ARCH%\nx86_64\n\n" +
+		"%BUILDDATE%\n1577836800\n\n" +
+		"%PACKAGER%\nArch Linux <arch@example.org>\n\n" +
+		"%PROVIDES%\nlibfoo.so=1-64\n\n" +
+		"%DEPENDS%\nglibc\nbash>=5\n\n" +
+		"%OPTDEPENDS%\npython: for scripts\n\n" +
+		"%MAKEDEPENDS%\ncmake\n\n"
+	if desc := readEntry(t, dbPath, "foo-1.0-1/desc"); desc != expected {
+		t.Errorf("unexpected desc:\n%s\nexpected:\n%s", desc, expected)
+	}
+	if files := readEntry(t, path.Join(dir, "local.files.tar.gz"), "foo-1.0-1/files"); files != "%FILES%\nusr/bin/foo\nusr/lib/libfoo\n\n" {
+		t.Errorf("unexpected files:\n%s", files)
+	}
+	for link, target := range map[string]string{
+		"local.db":    "local.db.tar.gz",
+		"local.files": "local.files.tar.gz",
+	} {
+		if dest, err := os.Readlink(path.Join(dir, link)); err != nil || dest != target {
+			t.Errorf("%s should link to %s, got %q %v", link, target, dest, err)
+		}
+	}
+
+	packages, err := ReadDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 2 || packages[0].Name != "bar" || packages[1].Name != "foo" {
+		t.Fatalf("unexpected packages %v", packages)
+	}
+	if !reflect.DeepEqual(packages[0].Depends, []string{"foo"}) || packages[0].Files != nil {
+		t.Errorf("unexpected bar %+v", packages[0])
+	}
+
+	// A new version replaces the old one, --remove deletes its file
+	foo2 := path.Join(dir, "foo-1.0-2-x86_64.pkg.tar.zst")
+	writePackage(t, foo2, strings.Replace(fooPkgInfo, "1.0-1", "1.0-2", 1), nil)
+	if err := RepoAdd(dbPath, true, false, foo2); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{foo, foo + ".sig"} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", file)
+		}
+	}
+	d, err := OpenDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for _, p := range d.Packages() {
+		versions = append(versions, p.Name+"-"+p.Version)
+	}
+	if !reflect.DeepEqual(versions, []string{"bar-2-1", "foo-1.0-2"}) {
+		t.Errorf("unexpected packages %v", versions)
+	}
+
+	if err := RepoRemove(dbPath, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if packages, _ := ReadDatabase(dbPath); len(packages) != 1 || packages[0].Name != "foo" {
+		t.Errorf("bar was not removed: %v", packages)
+	}
+	if err := RepoRemove(dbPath, "bar"); err == nil {
+		t.Error("expected an error removing a missing package")
+	}
+	if _, err := os.Stat(bar); err != nil {
+		t.Error("repo-remove should leave the package file alone")
+	}
+}
+
+func TestRepoAddReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repoadd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	foo := path.Join(dir, "foo-1.0-1-x86_64.pkg.tar.zst")
+	writePackage(t, foo, fooPkgInfo, nil)
+	foo2 := path.Join(dir, "foo-1.0-2-x86_64.pkg.tar.zst")
+	writePackage(t, foo2, strings.Replace(fooPkgInfo, "1.0-1", "1.0-2", 1), nil)
+	dbPath := path.Join(dir, "local.db.tar.gz")
+	if err := RepoAdd(dbPath, true, false, foo); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old file is kept as long as the old database points at it
+	if err := os.Mkdir(dbPath+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := RepoAdd(dbPath, true, false, foo2); err == nil {
+		t.Fatal("expected an error writing the database")
+	}
+	if _, err := os.Stat(foo); err != nil {
+		t.Errorf("%s was removed before the database was written", foo)
+	}
+	if err := os.Remove(dbPath + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RepoAdd(dbPath, true, false, foo2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(foo); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed", foo)
+	}
+
+	// With PreventDowngrade an older version does not replace a newer one
+	writePackage(t, foo, fooPkgInfo, nil)
+	if err := RepoAdd(dbPath, true, true, foo); err != nil {
+		t.Fatal(err)
+	}
+	packages, err := ReadDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 1 || packages[0].Version != "1.0-2" {
+		t.Errorf("unexpected packages %v", packages)
+	}
+	if _, err := os.Stat(foo2); err != nil {
+		t.Errorf("%s was removed for an older version", foo2)
+	}
+
+	// Without it the older version replaces the newer one like repo-add
+	if err := RepoAdd(dbPath, true, false, foo); err != nil {
+		t.Fatal(err)
+	}
+	packages, err = ReadDatabase(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 1 || packages[0].Version != "1.0-1" {
+		t.Errorf("unexpected packages %v", packages)
+	}
+	if _, err := os.Stat(foo2); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed", foo2)
+	}
+}
+
+func TestRepoAddSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repoadd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bar := path.Join(dir, "bar-2-1-any.pkg.tar.zst")
+	writePackage(t, bar, barPkgInfo, nil)
+	key, err := openpgp.NewEntity("Repo", "", "repo@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := OpenDatabase(path.Join(dir, "local.db.tar.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SignKey = key
+	if err := d.Add(bar); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"local.db", "local.files"} {
+		archive, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := os.Open(path.Join(dir, name+".sig"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = openpgp.CheckDetachedSignature(openpgp.EntityList{key}, bytes.NewReader(archive), sig)
+		sig.Close()
+		if err != nil {
+			t.Errorf("bad signature of %s: %s", name, err)
+		}
+	}
+
+	// Unsigned updates drop the stale signatures
+	d.SignKey = nil
+	if err := d.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "local.db.tar.zst.sig")); !os.IsNotExist(err) {
+		t.Error("stale signature was kept")
+	}
+}
+
+func TestOpenDatabaseInvalidName(t *testing.T) {
+	if _, err := OpenDatabase("/tmp/local.tar.gz"); err == nil {
+		t.Error("expected an error for a name without .db.tar")
+	}
+}
@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"strings"
+)
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || isAlpha(c)
+}
+
+// splitEVR splits [epoch:]version[-release], the epoch defaults to 0
+func splitEVR(evr string) (string, string, string) {
+	epoch := "0"
+	i := 0
+	for i < len(evr) && isDigit(evr[i]) {
+		i++
+	}
+	if i < len(evr) && evr[i] == ':' {
+		if i > 0 {
+			epoch = evr[:i]
+		}
+		evr = evr[i+1:]
+	}
+	if j := strings.LastIndex(evr, "-"); j != -1 {
+		return epoch, evr[:j], evr[j+1:]
+	}
+	return epoch, evr, ""
+}
+
+// rpmvercmp compares two version strings segment by segment the way libalpm
+// does
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	one, two := 0, 0
+	for one < len(a) && two < len(b) {
+		start1, start2 := one, two
+		for one < len(a) && !isAlnum(a[one]) {
+			one++
+		}
+		for two < len(b) && !isAlnum(b[two]) {
+			two++
+		}
+		if one == len(a) || two == len(b) {
+			break
+		}
+		// More separators make the newer version
+		if one-start1 != two-start2 {
+			if one-start1 < two-start2 {
+				return -1
+			}
+			return 1
+		}
+		ptr1, ptr2 := one, two
+		isNum := isDigit(a[ptr1])
+		if isNum {
+			for ptr1 < len(a) && isDigit(a[ptr1]) {
+				ptr1++
+			}
+			for ptr2 < len(b) && isDigit(b[ptr2]) {
+				ptr2++
+			}
+		} else {
+			for ptr1 < len(a) && isAlpha(a[ptr1]) {
+				ptr1++
+			}
+			for ptr2 < len(b) && isAlpha(b[ptr2]) {
+				ptr2++
+			}
+		}
+		seg1, seg2 := a[one:ptr1], b[two:ptr2]
+		// Segments of different types, numbers are newer
+		if seg2 == "" {
+			if isNum {
+				return 1
+			}
+			return -1
+		}
+		if isNum {
+			seg1 = strings.TrimLeft(seg1, "0")
+			seg2 = strings.TrimLeft(seg2, "0")
+			if len(seg1) != len(seg2) {
+				if len(seg1) > len(seg2) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if c := strings.Compare(seg1, seg2); c != 0 {
+			return c
+		}
+		one, two = ptr1, ptr2
+	}
+	if one == len(a) && two == len(b) {
+		return 0
+	}
+	// A remaining alpha segment never beats an empty one, e.g. 1.0rc < 1.0
+	if (one == len(a) && !isAlpha(b[two])) || (one < len(a) && isAlpha(a[one])) {
+		return -1
+	}
+	return 1
+}
+
+// VerCmp compares two package versions like vercmp(8). It returns -1, 0 or 1
+// if a is older, equal or newer than b. The release is only compared if both
+// have one.
+func VerCmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	epoch1, version1, release1 := splitEVR(a)
+	epoch2, version2, release2 := splitEVR(b)
+	if c := rpmvercmp(epoch1, epoch2); c != 0 {
+		return c
+	}
+	if c := rpmvercmp(version1, version2); c != 0 {
+		return c
+	}
+	if release1 != "" && release2 != "" {
+		return rpmvercmp(release1, release2)
+	}
+	return 0
+}
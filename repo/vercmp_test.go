@@ -0,0 +1,37 @@
+package repo
+
+import (
+	"testing"
+)
+
+func TestVerCmp(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.5.0", "1.5.0", 0},
+		{"1.5.1", "1.5.0", 1},
+		{"1.5.1", "1.5", 1},
+		{"1.5.0", "1.5", 1},
+		{"1.5b", "1.5", -1},
+		{"1.5a", "1.5b", -1},
+		{"1.0rc1", "1.0", -1},
+		{"1.0alpha", "1.0beta", -1},
+		{"1.001", "1.1", 0},
+		{"1.10", "1.9", 1},
+		{"1.0a", "1.0.1", -1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-2", "1.0.1-1", -1},
+		{"1.0", "1.0-5", 0},
+		{"1:1.0-1", "2.0-1", 1},
+		{"0:1.0", "1.0", 0},
+		{"1:1.0", "2:0.1", -1},
+	} {
+		if c := VerCmp(tc.a, tc.b); c != tc.expected {
+			t.Errorf("VerCmp(%s, %s) = %d, expected %d", tc.a, tc.b, c, tc.expected)
+		}
+		if c := VerCmp(tc.b, tc.a); c != -tc.expected {
+			t.Errorf("VerCmp(%s, %s) = %d, expected %d", tc.b, tc.a, c, -tc.expected)
+		}
+	}
+}
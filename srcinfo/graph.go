@@ -0,0 +1,149 @@
+package srcinfo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Graph holds which of a set of PKGBUILDs depend on each other
+type Graph struct {
+	Infos []*SRCINFO
+	// edges maps an index of Infos to the indexes it depends on
+	edges [][]int
+}
+
+// NewGraph resolves the dependencies of infos for arch against the names and
+// provides of each other. Dependencies outside of infos are left to pacman.
+func NewGraph(infos []*SRCINFO, arch string) (*Graph, error) {
+	providers := make(map[string]int)
+	for i, info := range infos {
+		for _, name := range info.Provides(arch) {
+			if j, ok := providers[name]; ok && j != i {
+				return nil, fmt.Errorf("%s is provided by both %s and %s", name, infos[j].Base, info.Base)
+			}
+			providers[name] = i
+		}
+	}
+	g := &Graph{Infos: infos, edges: make([][]int, len(infos))}
+	for i, info := range infos {
+		seen := make(map[int]bool)
+		for _, dep := range info.Depends(arch) {
+			j, ok := providers[dep]
+			if !ok || j == i || seen[j] {
+				continue
+			}
+			seen[j] = true
+			g.edges[i] = append(g.edges[i], j)
+		}
+	}
+	return g, nil
+}
+
+// Order returns the PKGBUILDs with every one after its dependencies, keeping
+// the given order where it does not matter
+func (g *Graph) Order() ([]*SRCINFO, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(g.Infos))
+	var order []*SRCINFO
+	var stack []int
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("Dependency cycle: %s", g.cycle(stack, i))
+		}
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, j := range g.edges[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = done
+		order = append(order, g.Infos[i])
+		return nil
+	}
+	for i := range g.Infos {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// cycle formats the part of stack starting at i, e.g. "a -> b -> a"
+func (g *Graph) cycle(stack []int, i int) string {
+	var names []string
+	for n := len(stack) - 1; n >= 0; n-- {
+		names = append([]string{g.Infos[stack[n]].Base}, names...)
+		if stack[n] == i {
+			break
+		}
+	}
+	return strings.Join(append(names, g.Infos[i].Base), " -> ")
+}
+
+// Requires returns the PKGBUILDs s needs built before it, directly or through
+// other PKGBUILDs
+func (g *Graph) Requires(s *SRCINFO) []*SRCINFO {
+	start := -1
+	for i, info := range g.Infos {
+		if info == s {
+			start = i
+		}
+	}
+	if start == -1 {
+		return nil
+	}
+	seen := map[int]bool{start: true}
+	var requires []*SRCINFO
+	queue := []int{start}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, j := range g.edges[i] {
+			if seen[j] {
+				continue
+			}
+			seen[j] = true
+			requires = append(requires, g.Infos[j])
+			queue = append(queue, j)
+		}
+	}
+	return requires
+}
+
+// Levels groups the PKGBUILDs so every one only depends on earlier groups,
+// the PKGBUILDs of a group can be built at once
+func (g *Graph) Levels() ([][]*SRCINFO, error) {
+	order, err := g.Order()
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[*SRCINFO]int)
+	for i, info := range g.Infos {
+		index[info] = i
+	}
+	level := make([]int, len(g.Infos))
+	var levels [][]*SRCINFO
+	for _, info := range order {
+		i := index[info]
+		for _, j := range g.edges[i] {
+			if level[j]+1 > level[i] {
+				level[i] = level[j] + 1
+			}
+		}
+		if level[i] == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[level[i]] = append(levels[level[i]], info)
+	}
+	return levels, nil
+}
@@ -0,0 +1,160 @@
+package srcinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Section holds the values of the pkgbase or a pkgname section, arch
+// specific keys like depends_x86_64 are kept as they are
+type Section map[string][]string
+
+// Package is a pkgname section of a .SRCINFO
+type Package struct {
+	Name    string
+	Section Section
+}
+
+// SRCINFO is a parsed .SRCINFO as written by makepkg --printsrcinfo
+type SRCINFO struct {
+	// Dir is where the PKGBUILD is
+	Dir      string
+	Base     string
+	Section  Section
+	Packages []*Package
+}
+
+// Parse reads a .SRCINFO
+func Parse(r io.Reader) (*SRCINFO, error) {
+	s := &SRCINFO{Section: make(Section)}
+	var section Section
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, " = ", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key, value := split[0], split[1]
+		switch key {
+		case "pkgbase":
+			if s.Base != "" {
+				return nil, fmt.Errorf("line %d: pkgbase given twice", lineno)
+			}
+			s.Base = value
+			section = s.Section
+			continue
+		case "pkgname":
+			if s.Base == "" {
+				return nil, fmt.Errorf("line %d: pkgname before pkgbase", lineno)
+			}
+			pkg := &Package{Name: value, Section: make(Section)}
+			s.Packages = append(s.Packages, pkg)
+			section = pkg.Section
+			continue
+		}
+		if section == nil {
+			return nil, fmt.Errorf("line %d: %s outside of a section", lineno, key)
+		}
+		section[key] = append(section[key], value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if s.Base == "" || len(s.Packages) == 0 {
+		return nil, fmt.Errorf("no pkgbase or pkgname")
+	}
+	return s, nil
+}
+
+// ParseDir reads the .SRCINFO next to a PKGBUILD
+func ParseDir(dir string) (*SRCINFO, error) {
+	filename := path.Join(dir, ".SRCINFO")
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s has no .SRCINFO, create it with makepkg --printsrcinfo", dir)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", filename, err)
+	}
+	s.Dir = dir
+	return s, nil
+}
+
+// values returns key and its arch specific variant
+func (s Section) values(key, arch string) ([]string, bool) {
+	values, ok := s[key]
+	archValues, archOk := s[key+"_"+arch]
+	return append(append([]string{}, values...), archValues...), ok || archOk
+}
+
+// Get returns the values of key for arch of the pkgbase section
+func (s *SRCINFO) Get(key, arch string) []string {
+	values, _ := s.Section.values(key, arch)
+	return values
+}
+
+// GetPackage returns the values of key for arch of a package, which override the
+// pkgbase values like they do in a PKGBUILD
+func (s *SRCINFO) GetPackage(pkg *Package, key, arch string) []string {
+	if values, ok := pkg.Section.values(key, arch); ok {
+		return values
+	}
+	return s.Get(key, arch)
+}
+
+// Version returns the full version, [epoch:]pkgver-pkgrel
+func (s *SRCINFO) Version() string {
+	version := strings.Join(s.Section["pkgver"], "") + "-" + strings.Join(s.Section["pkgrel"], "")
+	if epoch := strings.Join(s.Section["epoch"], ""); epoch != "" && epoch != "0" {
+		version = epoch + ":" + version
+	}
+	return version
+}
+
+// Provides returns the names of the packages and what they provide, without
+// versions
+func (s *SRCINFO) Provides(arch string) []string {
+	var provides []string
+	for _, pkg := range s.Packages {
+		provides = append(provides, pkg.Name)
+		for _, provide := range s.GetPackage(pkg, "provides", arch) {
+			provides = append(provides, depName(provide))
+		}
+	}
+	return provides
+}
+
+// Depends returns what is needed to build and install all packages, without
+// versions
+func (s *SRCINFO) Depends(arch string) []string {
+	var depends []string
+	for _, key := range []string{"makedepends", "checkdepends"} {
+		depends = append(depends, s.Get(key, arch)...)
+	}
+	for _, pkg := range s.Packages {
+		depends = append(depends, s.GetPackage(pkg, "depends", arch)...)
+	}
+	for i, dep := range depends {
+		depends[i] = depName(dep)
+	}
+	return depends
+}
+
+func depName(dep string) string {
+	if i := strings.IndexAny(dep, "<>="); i != -1 {
+		return dep[:i]
+	}
+	return dep
+}
@@ -0,0 +1,166 @@
+package srcinfo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var example = `pkgbase = foo
+	pkgdesc = An example
+	pkgver = 1.0
+	pkgrel = 2
+	epoch = 1
+	arch = x86_64
+	makedepends = make>=4
+	depends = glibc
+	depends_x86_64 = lib32-glibc
+
+pkgname = foo
+
+pkgname = foo-docs
+	depends = foo=1:1.0
+	provides = foo-doc
+`
+
+func parse(t *testing.T, s string) *SRCINFO {
+	info, err := Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestParse(t *testing.T) {
+	info := parse(t, example)
+	if info.Base != "foo" || len(info.Packages) != 2 {
+		t.Fatalf("unexpected %+v", info)
+	}
+	if v := info.Version(); v != "1:1.0-2" {
+		t.Errorf("unexpected version %s", v)
+	}
+	if p := info.Provides("x86_64"); !reflect.DeepEqual(p, []string{"foo", "foo-docs", "foo-doc"}) {
+		t.Errorf("unexpected provides %v", p)
+	}
+	expected := []string{"make", "glibc", "lib32-glibc", "foo"}
+	if d := info.Depends("x86_64"); !reflect.DeepEqual(d, expected) {
+		t.Errorf("unexpected depends %v", d)
+	}
+	expected = []string{"make", "glibc", "foo"}
+	if d := info.Depends("aarch64"); !reflect.DeepEqual(d, expected) {
+		t.Errorf("unexpected depends %v", d)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"pkgname = foo\n",
+		"pkgbase = foo\n",
+		"pkgbase = foo\npkgname = foo\nbroken\n",
+		"pkgver = 1\npkgbase = foo\npkgname = foo\n",
+	} {
+		if _, err := Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestParseDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srcinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := ParseDir(dir); err == nil || !strings.Contains(err.Error(), "--printsrcinfo") {
+		t.Errorf("expected a hint to create the .SRCINFO, got %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, ".SRCINFO"), []byte(example), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ParseDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Dir != dir {
+		t.Errorf("unexpected dir %s", info.Dir)
+	}
+}
+
+func pkgbuild(t *testing.T, name string, depends ...string) *SRCINFO {
+	s := "pkgbase = " + name + "\n\tpkgver = 1\n\tpkgrel = 1\n"
+	for _, dep := range depends {
+		s += "\tdepends = " + dep + "\n"
+	}
+	return parse(t, s+"pkgname = "+name+"\n\tprovides = "+name+"-provider\n")
+}
+
+func bases(infos []*SRCINFO) []string {
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Base)
+	}
+	return names
+}
+
+func TestGraphOrder(t *testing.T) {
+	app := pkgbuild(t, "app", "libb", "glibc")
+	libb := pkgbuild(t, "libb", "liba-provider>=1")
+	liba := pkgbuild(t, "liba")
+	other := pkgbuild(t, "other")
+	g, err := NewGraph([]*SRCINFO{app, other, libb, liba}, "x86_64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := g.Order()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := bases(order); !reflect.DeepEqual(names, []string{"liba", "libb", "app", "other"}) {
+		t.Errorf("unexpected order %v", names)
+	}
+	if names := bases(g.Requires(app)); !reflect.DeepEqual(names, []string{"libb", "liba"}) {
+		t.Errorf("unexpected requires %v", names)
+	}
+	if names := bases(g.Requires(liba)); len(names) != 0 {
+		t.Errorf("unexpected requires %v", names)
+	}
+	levels, err := g.Levels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names [][]string
+	for _, level := range levels {
+		names = append(names, bases(level))
+	}
+	if !reflect.DeepEqual(names, [][]string{{"liba", "other"}, {"libb"}, {"app"}}) {
+		t.Errorf("unexpected levels %v", names)
+	}
+}
+
+func TestGraphCycle(t *testing.T) {
+	g, err := NewGraph([]*SRCINFO{
+		pkgbuild(t, "a", "b"),
+		pkgbuild(t, "b", "c"),
+		pkgbuild(t, "c", "b"),
+	}, "x86_64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.Order()
+	if err == nil || err.Error() != "Dependency cycle: b -> c -> b" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestGraphDuplicateProvider(t *testing.T) {
+	_, err := NewGraph([]*SRCINFO{
+		pkgbuild(t, "a"),
+		parse(t, "pkgbase = b\npkgname = b\n\tprovides = a-provider\n"),
+	}, "x86_64")
+	if err == nil {
+		t.Errorf("expected an error for two providers")
+	}
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/foxboron/devtools/container"
+)
+
+const binfmtPath = "/proc/sys/fs/binfmt_misc"
+
+// Architecture describes how binaries of a pacman architecture are executed
+// on the host.
+type Architecture struct {
+	Name string
+	// Personality is passed to the container for architectures the host can
+	// run natively in a 32-bit personality (linux32)
+	Personality string
+	// Interpreter is the qemu-user binary for foreign architectures, Magic and
+	// Mask are the binfmt_misc match for its ELF header
+	Interpreter string
+	Magic       string
+	Mask        string
+}
+
+var (
+	// Architectures we know how to build for
+	Architectures = map[string]Architecture{
+		"x86_64": {Name: "x86_64"},
+		"i686":   {Name: "i686", Personality: "x86"},
+		"aarch64": {
+			Name:        "aarch64",
+			Interpreter: "/usr/bin/qemu-aarch64-static",
+			Magic:       `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`,
+			Mask:        `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+		},
+		"armv7h": {
+			Name:        "armv7h",
+			Interpreter: "/usr/bin/qemu-arm-static",
+			Magic:       `\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`,
+			Mask:        `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+		},
+		"riscv64": {
+			Name:        "riscv64",
+			Interpreter: "/usr/bin/qemu-riscv64-static",
+			Magic:       `\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`,
+			Mask:        `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+		},
+	}
+
+	// GOARCH -> pacman architecture
+	hostArchitectures = map[string]string{
+		"amd64":   "x86_64",
+		"386":     "i686",
+		"arm64":   "aarch64",
+		"arm":     "armv7h",
+		"riscv64": "riscv64",
+	}
+)
+
+// HostArchitecture returns the pacman architecture of the running host
+func HostArchitecture() string {
+	return hostArchitectures[runtime.GOARCH]
+}
+
+// GetArchitecture looks up a pacman architecture. An empty name is the host
+// architecture.
+func GetArchitecture(name string) (Architecture, error) {
+	if name == "" {
+		name = HostArchitecture()
+	}
+	arch, ok := Architectures[name]
+	if !ok {
+		return Architecture{}, fmt.Errorf("Unsupported architecture %s", name)
+	}
+	return arch, nil
+}
+
+// IsForeign reports if the architecture needs an emulator on this host
+func (a Architecture) IsForeign() bool {
+	if a.Name == HostArchitecture() {
+		return false
+	}
+	return a.Personality == "" || HostArchitecture() != "x86_64"
+}
+
+func (a Architecture) binfmtName() string {
+	return strings.TrimSuffix(path.Base(a.Interpreter), "-static")
+}
+
+// RegisterBinfmt registers the qemu-user interpreter with binfmt_misc unless
+// an entry for it already exists, e.g. from systemd-binfmt.
+func RegisterBinfmt(arch Architecture) error {
+	if arch.Interpreter == "" {
+		return fmt.Errorf("No emulator known for %s", arch.Name)
+	}
+	if _, err := os.Stat(arch.Interpreter); os.IsNotExist(err) {
+		return fmt.Errorf("%s is missing, install qemu-user-static", arch.Interpreter)
+	}
+	if _, err := os.Stat(path.Join(binfmtPath, "register")); os.IsNotExist(err) {
+		if err := syscall.Mount("binfmt_misc", binfmtPath, "binfmt_misc", 0, ""); err != nil {
+			return fmt.Errorf("Could not mount binfmt_misc: %s", err)
+		}
+	}
+	if _, err := os.Stat(path.Join(binfmtPath, arch.binfmtName())); err == nil {
+		return nil
+	}
+	// F opens the interpreter at registration so it resolves in any mount namespace
+	entry := fmt.Sprintf(":%s:M::%s:%s:%s:F", arch.binfmtName(), arch.Magic, arch.Mask, arch.Interpreter)
+	if err := ioutil.WriteFile(path.Join(binfmtPath, "register"), []byte(entry), 0200); err != nil {
+		return fmt.Errorf("Could not register %s with binfmt_misc: %s", arch.Interpreter, err)
+	}
+	return nil
+}
+
+// SetupArchitecture prepares the container to execute binaries for the given
+// architecture. 32-bit x86 runs under the linux32 personality unless setarch
+// is false, foreign architectures get their qemu-user interpreter registered
+// and bound into the container.
+func SetupArchitecture(container container.Container, name string, setarch bool) error {
+	arch, err := GetArchitecture(name)
+	if err != nil {
+		return err
+	}
+	if !arch.IsForeign() {
+		if setarch && arch.Name != HostArchitecture() {
+			container.SetPersonality(arch.Personality)
+		}
+		return nil
+	}
+	if err := RegisterBinfmt(arch); err != nil {
+		return err
+	}
+	container.SetBindRoDir(arch.Interpreter, arch.Interpreter)
+	return nil
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ChecksumFiles maps the checksum files published next to release artifacts
+// to the hash they contain
+var ChecksumFiles = map[string]func() hash.Hash{
+	"sha256sums.txt": sha256.New,
+	"b2sums.txt": func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// ChecksumError is returned when a file does not match its expected checksum
+type ChecksumError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Checksum mismatch for %s: expected %s, got %s", e.Path, e.Expected, e.Actual)
+}
+
+// ParseChecksums reads a sha256sums.txt style file and returns a map of
+// filename -> hex digest
+func ParseChecksums(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// Binary mode entries are prefixed with *
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums, scanner.Err()
+}
+
+// FileChecksum returns the hex digest of a file
+func FileChecksum(filename string, newHash func() hash.Hash) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksum compares the digest of a file with the expected hex digest.
+// A mismatch returns a *ChecksumError.
+func VerifyChecksum(filename, expected string, newHash func() hash.Hash) error {
+	actual, err := FileChecksum(filename, newHash)
+	if err != nil {
+		return err
+	}
+	if actual != strings.ToLower(expected) {
+		return &ChecksumError{Path: filename, Expected: expected, Actual: actual}
+	}
+	return nil
+}
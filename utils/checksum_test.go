@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Known digests of "" and "abc"
+var knownDigests = map[string]map[string]string{
+	"sha256sums.txt": {
+		"":    "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"abc": "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	},
+	"b2sums.txt": {
+		"":    "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce",
+		"abc": "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923",
+	},
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"":    path.Join(dir, "empty"),
+		"abc": path.Join(dir, "abc"),
+	}
+	for content, file := range files {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for sumsFile, digests := range knownDigests {
+		newHash := ChecksumFiles[sumsFile]
+		for content, digest := range digests {
+			actual, err := FileChecksum(files[content], newHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != digest {
+				t.Errorf("%s of %q is %s, expected %s", sumsFile, content, actual, digest)
+			}
+			if err := VerifyChecksum(files[content], strings.ToUpper(digest), newHash); err != nil {
+				t.Error(err)
+			}
+		}
+		err := VerifyChecksum(files["abc"], digests[""], newHash)
+		if _, ok := err.(*ChecksumError); !ok {
+			t.Errorf("%s: expected a checksum mismatch, got %v", sumsFile, err)
+		}
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sha256 := knownDigests["sha256sums.txt"]
+	sums := sha256[""] + "  archlinux-x86_64.iso\n" +
+		strings.ToUpper(sha256["abc"]) + " *archlinux-bootstrap-x86_64.tar.gz\n" +
+		"# checksums of the release\n"
+	sumsPath := path.Join(dir, "sha256sums.txt")
+	if err := ioutil.WriteFile(sumsPath, []byte(sums), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksums, err := ParseChecksums(sumsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checksums) != 2 {
+		t.Errorf("expected 2 checksums, got %v", checksums)
+	}
+	if checksums["archlinux-x86_64.iso"] != sha256[""] {
+		t.Errorf("unexpected checksum for the iso: %s", checksums["archlinux-x86_64.iso"])
+	}
+	if checksums["archlinux-bootstrap-x86_64.tar.gz"] != sha256["abc"] {
+		t.Errorf("unexpected checksum for the tarball: %s", checksums["archlinux-bootstrap-x86_64.tar.gz"])
+	}
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneTree populates dst with a copy of src using the cheapest mechanism
+// available. Files are reflinked if the filesystem supports it and copied
+// otherwise, never shared with src. Ownership, permissions, modification
+// times and extended attributes are preserved.
+func CloneTree(src, dst string) error {
+	src = filepath.Clean(src)
+	reflink := true
+	var dirs []string
+	progress := NewProgress("Copying "+src, -1)
+	progress.Unit = "files"
+	defer progress.Done()
+	err := filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		progress.Add(1)
+		rel, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+		stat := info.Sys().(*syscall.Stat_t)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(dstPath, mode.Perm()); err != nil {
+				return err
+			}
+			dirs = append(dirs, rel)
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dstPath); err != nil {
+				return err
+			}
+			return os.Lchown(dstPath, int(stat.Uid), int(stat.Gid))
+		case mode.IsRegular():
+			if reflink {
+				err := cloneFile(srcPath, dstPath, true)
+				if err == nil {
+					break
+				}
+				os.Remove(dstPath)
+				if !isUnsupported(err) {
+					return err
+				}
+				reflink = false
+			}
+			if err := cloneFile(srcPath, dstPath, false); err != nil {
+				return err
+			}
+		default:
+			if err := unix.Mknod(dstPath, stat.Mode, int(stat.Rdev)); err != nil {
+				return err
+			}
+		}
+		return copyMetadata(srcPath, dstPath, info)
+	})
+	if err != nil {
+		return err
+	}
+	// Directory times change while we fill them, so they are set last
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return err
+		}
+		if err := os.Chtimes(filepath.Join(dst, dirs[i]), info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUnsupported reports if a reflink failed because the filesystem can't
+func isUnsupported(err error) bool {
+	switch err {
+	case unix.EOPNOTSUPP, unix.EXDEV, unix.EINVAL, unix.ENOTTY, unix.ENOSYS:
+		return true
+	}
+	return false
+}
+
+// cloneFile reflinks or copies the contents of a file
+func cloneFile(srcPath, dstPath string, reflink bool) error {
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dstPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if reflink {
+		err = unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	} else {
+		_, err = io.Copy(out, in)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func copyMetadata(srcPath, dstPath string, info os.FileInfo) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(dstPath, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+	if err := copyXattrs(srcPath, dstPath); err != nil {
+		return err
+	}
+	// chown clears setuid and setgid, so the mode is applied afterwards
+	if err := os.Chmod(dstPath, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	return os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+}
+
+func copyXattrs(srcPath, dstPath string) error {
+	size, err := unix.Llistxattr(srcPath, nil)
+	if err != nil || size == 0 {
+		// No xattr support on the source means nothing to copy
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(srcPath, buf)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		valueSize, err := unix.Lgetxattr(srcPath, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Lgetxattr(srcPath, name, value)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dstPath, name, value[:valueSize], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
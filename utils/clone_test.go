@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCloneTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := path.Join(dir, "pristine")
+	dst := path.Join(dir, "root")
+
+	for filename, mode := range map[string]os.FileMode{
+		"usr/bin/bash":     0755,
+		"etc/locale.gen":   0644,
+		"etc/shadow":       0600,
+		"var/lib/pacman/x": 0644,
+	} {
+		if err := CreateFile(src, filename, []byte(filename), mode); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(path.Join(src, filename), mode)
+	}
+	if err := os.Symlink("usr/bin", path.Join(src, "bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CloneTree(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if link, err := os.Readlink(path.Join(dst, "bin")); err != nil || link != "usr/bin" {
+		t.Errorf("bin was not cloned as a symlink: %v", err)
+	}
+	info, err := os.Stat(path.Join(dst, "etc/shadow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("etc/shadow has mode %s", info.Mode())
+	}
+
+	// Writing to the clone must never change the pristine tree
+	if err := ioutil.WriteFile(path.Join(dst, "etc/locale.gen"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadFile(path.Join(src, "etc/locale.gen")); string(buf) != "etc/locale.gen" {
+		t.Error("pristine etc/locale.gen was modified through the clone")
+	}
+	if buf, _ := ioutil.ReadFile(path.Join(dst, "usr/bin/bash")); string(buf) != "usr/bin/bash" {
+		t.Error("usr/bin/bash was not cloned")
+	}
+	if err := ioutil.WriteFile(path.Join(dst, "usr/bin/bash"), []byte("changed"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(dst, "usr/bin/bash"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(path.Join(src, "usr/bin/bash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadFile(path.Join(src, "usr/bin/bash")); string(buf) != "usr/bin/bash" || info.Mode().Perm() != 0755 {
+		t.Error("pristine usr/bin/bash was modified through the clone")
+	}
+}
@@ -95,14 +95,19 @@ func SetupMakepkg(container container.Container) error {
 
 // MoveProducts moves the created products from the container to
 // the desired locations.
+// Products without a destination in makepkg.conf are put in startdir, the
+// working directory when empty.
 // Returns a map of {PKGDEST, LOGDEST, SRCPKGDEST} -> filename -> destination path
-func MoveProducts(container container.Container) (map[string]map[string]string, error) {
+func MoveProducts(container container.Container, startdir string) (map[string]map[string]string, error) {
 	var products = make(map[string]map[string]string)
+	if startdir == "" {
+		startdir, _ = os.Getwd()
+	}
 
 	// pkgdest
 	pkgdest := makepkg.MakepkgConf("PKGDEST")
 	if pkgdest == "" {
-		pkgdest, _ = os.Getwd()
+		pkgdest = startdir
 	}
 
 	files, err := CopyDir(path.Join(container.GetPath(), "pkgdest"), pkgdest)
@@ -114,7 +119,7 @@ func MoveProducts(container container.Container) (map[string]map[string]string,
 	// logdest
 	logdest := makepkg.MakepkgConf("LOGDEST")
 	if logdest == "" {
-		logdest, _ = os.Getwd()
+		logdest = startdir
 	}
 	files, err = CopyDir(path.Join(container.GetPath(), "logdest"), logdest)
 	if err != nil {
@@ -125,7 +130,7 @@ func MoveProducts(container container.Container) (map[string]map[string]string,
 	// // srcpkgdest
 	srcpkgdest := makepkg.MakepkgConf("SRCPKGDEST")
 	if srcpkgdest == "" {
-		srcpkgdest, _ = os.Getwd()
+		srcpkgdest = startdir
 	}
 	files, err = CopyDir(path.Join(container.GetPath(), "srcpkgdest"), srcpkgdest)
 	if err != nil {
@@ -1,54 +1,227 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
-	"os/exec"
+	"strings"
+	"time"
 
 	openpgp "golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
-// This doesn't work. Need actual public key...
-func VerifySignatureOpenPGP(filepath, signaturePath string) {
-	signature, err := os.Open(signaturePath)
+const (
+	// ArchlinuxKeyring is the keyring shipped by archlinux-keyring
+	ArchlinuxKeyring = "/usr/share/pacman/keyrings/archlinux.gpg"
+
+	// Certifications from trusted keys a key needs, pacman-key gives the
+	// master keys marginal trust and gpg requires three of them
+	trustedCertifications = 3
+
+	// Not defined by x/crypto/openpgp
+	sigTypeCertificationRevocation packet.SignatureType = 0x30
+)
+
+var (
+	ErrUnknownSigner   = errors.New("signature made by a key not in the keyring")
+	ErrBadSignature    = errors.New("bad signature")
+	ErrRevokedSigner   = errors.New("signature made by a revoked key")
+	ErrUntrustedSigner = errors.New("signature made by a key neither trusted nor signed by a trusted key")
+)
+
+// SignatureError is returned when a file fails signature verification.
+// Err is ErrUnknownSigner, ErrBadSignature or the underlying read error.
+type SignatureError struct {
+	Path string
+	Err  error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("Could not verify %s: %s", e.Path, e.Err)
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// isArmored peeks at the reader to see if it holds ASCII armor
+func isArmored(r *bufio.Reader) bool {
+	header, _ := r.Peek(len("-----BEGIN"))
+	return bytes.Equal(header, []byte("-----BEGIN"))
+}
+
+// ReadKeyring reads a binary or armored keyring from a file
+func ReadKeyring(keyringPath string) (openpgp.EntityList, error) {
+	f, err := os.Open(keyringPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("Could not open keyring %s: %s", keyringPath, err)
 	}
-	key, err := os.Open(signaturePath)
-	if err != nil {
-		log.Fatal(err)
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var keyring openpgp.EntityList
+	if isArmored(r) {
+		keyring, err = openpgp.ReadArmoredKeyRing(r)
+	} else {
+		keyring, err = openpgp.ReadKeyRing(r)
 	}
-	verifyTarget, err := os.Open(filepath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("Could not read keyring %s: %s", keyringPath, err)
 	}
+	return keyring, nil
+}
 
-	keyIssues, err := openpgp.ReadKeyRing(key)
-	if err != nil {
-		log.Fatal(err)
+// readFingerprints reads the fingerprints of a -trusted or -revoked file of a
+// keyring, the first field of every line. A missing file returns nil.
+func readFingerprints(filename string) (map[string]bool, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-	entity, err := openpgp.CheckArmoredDetachedSignature(keyIssues, verifyTarget, signature)
-	if err != nil {
-		entity, err := openpgp.CheckDetachedSignature(keyIssues, verifyTarget, signature)
-		if err != nil {
-			fmt.Println("lol")
-			fmt.Println(entity)
-			log.Fatal()
+	defer f.Close()
+	fingerprints := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		fmt.Println(entity.PrimaryKey)
+		fingerprints[strings.ToUpper(strings.SplitN(line, ":", 2)[0])] = true
 	}
-	fmt.Println(entity.PrimaryKey)
+	return fingerprints, scanner.Err()
 }
 
-// Verify signature with gnupg
-func VerifySignature(filepath, signaturePath string) error {
-	var cmd *exec.Cmd
-	cmd = exec.Command("/usr/bin/gpg", "--verify", signaturePath, filepath)
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-	err := cmd.Run()
+func fingerprint(entity *openpgp.Entity) string {
+	return fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+}
+
+// isCertification reports if sig certifies a user ID, signature types 0x10 to
+// 0x13 of RFC 4880
+func isCertification(sig *packet.Signature) bool {
+	return sig.SigType >= packet.SigTypeGenericCert && sig.SigType <= packet.SigTypePositiveCert
+}
+
+func sigExpired(sig *packet.Signature, now time.Time) bool {
+	if sig.SigLifetimeSecs == nil || *sig.SigLifetimeSecs == 0 {
+		return false
+	}
+	return now.After(sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second))
+}
+
+// certifiers returns the trusted keys with a valid certification of an
+// identity of entity. Expired signatures are skipped and a certification
+// revocation of the same issuer cancels its older certifications.
+func certifiers(entity *openpgp.Entity, keyring openpgp.EntityList, trusted, revoked map[string]bool) map[string]bool {
+	now := time.Now()
+	issuers := make(map[string]bool)
+	for name, identity := range entity.Identities {
+		certified := make(map[string]time.Time)
+		revocations := make(map[string]time.Time)
+		for _, sig := range identity.Signatures {
+			if sig.IssuerKeyId == nil || sigExpired(sig, now) {
+				continue
+			}
+			if !isCertification(sig) && sig.SigType != sigTypeCertificationRevocation {
+				continue
+			}
+			for _, key := range keyring.KeysById(*sig.IssuerKeyId) {
+				issuer := fingerprint(key.Entity)
+				if !trusted[issuer] || revoked[issuer] {
+					continue
+				}
+				if key.PublicKey.VerifyUserIdSignature(name, entity.PrimaryKey, sig) != nil {
+					continue
+				}
+				times := certified
+				if sig.SigType == sigTypeCertificationRevocation {
+					times = revocations
+				}
+				if t, ok := times[issuer]; !ok || sig.CreationTime.After(t) {
+					times[issuer] = sig.CreationTime
+				}
+			}
+		}
+		for issuer, t := range certified {
+			if r, ok := revocations[issuer]; !ok || r.Before(t) {
+				issuers[issuer] = true
+			}
+		}
+	}
+	return issuers
+}
+
+// isTrusted reports if entity is a trusted key or is certified by enough
+// trusted keys, the way pacman-key validates packager keys through the master
+// keys
+func isTrusted(entity *openpgp.Entity, keyring openpgp.EntityList, trusted, revoked map[string]bool) bool {
+	if trusted[fingerprint(entity)] {
+		return true
+	}
+	return len(certifiers(entity, keyring, trusted, revoked)) >= trustedCertifications
+}
+
+// VerifySignatureOpenPGP checks the detached signature of a file against the
+// given keyring and returns the fingerprint of the signing key. Like
+// pacman-key, keys listed in the <keyring>-revoked file next to the keyring
+// are rejected. If there is a <keyring>-trusted file, the key has to be listed
+// in it or carry valid certifications from three of the keys listed in it.
+// Keyrings without one trust all their keys. Failed verification returns a
+// *SignatureError.
+func VerifySignatureOpenPGP(filepath, signaturePath, keyringPath string) (string, error) {
+	keyring, err := ReadKeyring(keyringPath)
+	if err != nil {
+		return "", err
+	}
+	base := strings.TrimSuffix(keyringPath, ".gpg")
+	trusted, err := readFingerprints(base + "-trusted")
+	if err != nil {
+		return "", err
+	}
+	revoked, err := readFingerprints(base + "-revoked")
 	if err != nil {
-		return err
+		return "", err
+	}
+	verifyTarget, err := os.Open(filepath)
+	if err != nil {
+		return "", err
+	}
+	defer verifyTarget.Close()
+	signature, err := os.Open(signaturePath)
+	if err != nil {
+		return "", &SignatureError{Path: filepath, Err: err}
+	}
+	defer signature.Close()
+
+	var entity *openpgp.Entity
+	r := bufio.NewReader(signature)
+	if isArmored(r) {
+		entity, err = openpgp.CheckArmoredDetachedSignature(keyring, verifyTarget, r)
+	} else {
+		entity, err = openpgp.CheckDetachedSignature(keyring, verifyTarget, r)
+	}
+	switch err.(type) {
+	case nil:
+		switch {
+		case revoked[fingerprint(entity)]:
+			return "", &SignatureError{Path: filepath, Err: ErrRevokedSigner}
+		case trusted != nil && !isTrusted(entity, keyring, trusted, revoked):
+			return "", &SignatureError{Path: filepath, Err: ErrUntrustedSigner}
+		}
+		return fingerprint(entity), nil
+	case pgperrors.SignatureError, pgperrors.StructuralError:
+		return "", &SignatureError{Path: filepath, Err: ErrBadSignature}
+	}
+	if err == pgperrors.ErrUnknownIssuer {
+		return "", &SignatureError{Path: filepath, Err: ErrUnknownSigner}
+	}
+	if err == io.EOF {
+		return "", &SignatureError{Path: filepath, Err: ErrBadSignature}
 	}
-	return nil
+	return "", &SignatureError{Path: filepath, Err: err}
 }
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	openpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func writeKeyring(t *testing.T, filename string, entities ...*openpgp.Entity) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, entity := range entities {
+		if err := entity.Serialize(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func detachSign(t *testing.T, filename string, signer *openpgp.Entity, content string) {
+	sig, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sig.Close()
+	if err := openpgp.DetachSign(sig, signer, strings.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifySignatureOpenPGP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	signer, err := openpgp.NewEntity("Release", "", "release@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("Other", "", "other@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := path.Join(dir, "keyring.gpg")
+	writeKeyring(t, keyring, signer)
+	otherKeyring := path.Join(dir, "other.gpg")
+	writeKeyring(t, otherKeyring, other)
+
+	file := path.Join(dir, "bootstrap.tar.gz")
+	if err := ioutil.WriteFile(file, []byte("tarball"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	detachSign(t, file+".sig", signer, "tarball")
+
+	fingerprint, err := VerifySignatureOpenPGP(file, file+".sig", keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint) {
+		t.Errorf("unexpected fingerprint %s", fingerprint)
+	}
+
+	_, err = VerifySignatureOpenPGP(file, file+".sig", otherKeyring)
+	if !errors.Is(err, ErrUnknownSigner) {
+		t.Errorf("expected unknown signer, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifySignatureOpenPGP(file, file+".sig", keyring)
+	if !errors.Is(err, ErrBadSignature) {
+		t.Errorf("expected bad signature, got %v", err)
+	}
+}
+
+// certify signs every identity of entity with signer
+func certify(t *testing.T, entity, signer *openpgp.Entity, sigType packet.SignatureType, created time.Time, lifetime uint32) {
+	for name, identity := range entity.Identities {
+		sig := &packet.Signature{
+			SigType:      sigType,
+			PubKeyAlgo:   signer.PrivateKey.PubKeyAlgo,
+			Hash:         crypto.SHA256,
+			CreationTime: created,
+			IssuerKeyId:  &signer.PrivateKey.KeyId,
+		}
+		if lifetime != 0 {
+			sig.SigLifetimeSecs = &lifetime
+		}
+		if err := sig.SignUserId(name, entity.PrimaryKey, signer.PrivateKey, nil); err != nil {
+			t.Fatal(err)
+		}
+		identity.Signatures = append(identity.Signatures, sig)
+	}
+}
+
+func TestVerifySignatureOpenPGPTrust(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"master1", "master2", "master3", "packager", "single", "revokedcert", "expiredcert", "revoked", "rogue"}
+	entities := make(map[string]*openpgp.Entity)
+	var keys []*openpgp.Entity
+	for _, name := range names {
+		entity, err := openpgp.NewEntity(name, "", name+"@example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entities[name] = entity
+		keys = append(keys, entity)
+	}
+	masters := []*openpgp.Entity{entities["master1"], entities["master2"], entities["master3"]}
+	created := time.Now().Add(-time.Hour)
+	for _, name := range []string{"packager", "revokedcert", "expiredcert", "revoked"} {
+		for _, master := range masters {
+			certify(t, entities[name], master, packet.SigTypeGenericCert, created, 0)
+		}
+	}
+	// Only one master key, or a second signature of the same one
+	certify(t, entities["single"], entities["master1"], packet.SigTypePositiveCert, created, 0)
+	certify(t, entities["single"], entities["master1"], packet.SigTypeGenericCert, created, 0)
+	// A later revocation of one of the certifications
+	certify(t, entities["revokedcert"], entities["master2"], sigTypeCertificationRevocation, created.Add(time.Minute), 0)
+	// An extra certification of the rogue key that is a revocation
+	certify(t, entities["rogue"], entities["master1"], sigTypeCertificationRevocation, created, 0)
+	// A certification that expired after a minute
+	expired := entities["expiredcert"]
+	for _, identity := range expired.Identities {
+		identity.Signatures = identity.Signatures[:2]
+	}
+	certify(t, expired, entities["master3"], packet.SigTypeGenericCert, created, 60)
+
+	keyring := path.Join(dir, "archlinux.gpg")
+	writeKeyring(t, keyring, keys...)
+	var trusted string
+	for _, master := range masters {
+		trusted += fmt.Sprintf("%X:4:\n", master.PrimaryKey.Fingerprint)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "archlinux-trusted"), []byte(trusted), 0644); err != nil {
+		t.Fatal(err)
+	}
+	revoked := fmt.Sprintf("%X\n", entities["revoked"].PrimaryKey.Fingerprint)
+	if err := ioutil.WriteFile(path.Join(dir, "archlinux-revoked"), []byte(revoked), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(dir, "bootstrap.tar.gz")
+	if err := ioutil.WriteFile(file, []byte("tarball"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		signer   string
+		expected error
+	}{
+		{"master1", nil},
+		{"packager", nil},
+		{"single", ErrUntrustedSigner},
+		{"revokedcert", ErrUntrustedSigner},
+		{"expiredcert", ErrUntrustedSigner},
+		{"revoked", ErrRevokedSigner},
+		{"rogue", ErrUntrustedSigner},
+	} {
+		detachSign(t, file+".sig", entities[tc.signer], "tarball")
+		_, err := VerifySignatureOpenPGP(file, file+".sig", keyring)
+		if tc.expected == nil && err != nil {
+			t.Errorf("%s: expected valid signature, got %v", tc.signer, err)
+		} else if !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.signer, tc.expected, err)
+		}
+	}
+}
@@ -1,28 +1,388 @@
 package utils
 
 import (
+	"context"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-func DownloadFile(filepath string, url string) error {
-	out, err := os.Create(filepath)
+// Defaults for downloads. The client gives up on mirrors which do not
+// connect or answer, downloads themselves take as long as they need while
+// data keeps coming.
+var (
+	DownloadRetries  = 3
+	DownloadBackoff  = time.Second
+	DownloadParallel = 4
+	DownloadClient   = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+	// DownloadStallTimeout aborts an attempt which received nothing for as
+	// long
+	DownloadStallTimeout = time.Minute
+	// RequestTimeout bounds the small requests of Fetch and URLExists
+	RequestTimeout = 30 * time.Second
+)
+
+// Download fetches a file from the first of its URLs which serves it.
+// Failed attempts are retried with an exponential backoff and continue the
+// partial download where the server supports it.
+type Download struct {
+	Path string
+	// URLs are tried in order, e.g. the same file on every mirror
+	URLs []string
+	// Size is the expected size in bytes, unchecked if 0
+	Size int64
+	// Checksum is the expected hex encoded NewHash sum, unchecked if empty
+	Checksum string
+	NewHash  func() hash.Hash
+	// Retries per URL after the first attempt
+	Retries int
+	// Backoff is the delay before the first retry, doubled for every further
+	// retry
+	Backoff time.Duration
+	// Progress is called with the bytes written so far and the total size,
+	// which is -1 when the server doesn't tell
+	Progress func(written, total int64)
+	Client   *http.Client
+}
+
+// HTTPError is returned for responses other than the ones we asked for
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("Could not download %s: %s", e.URL, e.Status)
+}
+
+// temporary reports if trying the same URL again might succeed
+func (e *HTTPError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+// NewDownload returns a Download of urls to filepath with the default retries
+func NewDownload(filepath string, urls ...string) *Download {
+	return &Download{
+		Path:    filepath,
+		URLs:    urls,
+		Retries: DownloadRetries,
+		Backoff: DownloadBackoff,
+		Client:  DownloadClient,
+	}
+}
+
+// progressWriter reports the bytes written through it
+type progressWriter struct {
+	written, total int64
+	progress       func(written, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if p.progress != nil {
+		p.progress(p.written, p.total)
+	}
+	return len(b), nil
+}
+
+// stallReader cancels a request once reading from its body stalls
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s *stallReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	s.timer.Reset(DownloadStallTimeout)
+	return n, err
+}
+
+// partSource records the URL and validator a partial download came from in
+// a file next to it
+type partSource struct {
+	URL       string
+	Validator string
+}
+
+func readPartSource(tmpPath string) partSource {
+	buf, err := ioutil.ReadFile(tmpPath + ".source")
 	if err != nil {
-		return err
+		return partSource{}
+	}
+	lines := strings.SplitN(string(buf), "\n", 3)
+	if len(lines) < 2 {
+		return partSource{}
+	}
+	return partSource{URL: lines[0], Validator: lines[1]}
+}
+
+func writePartSource(tmpPath string, source partSource) error {
+	return ioutil.WriteFile(tmpPath+".source", []byte(source.URL+"\n"+source.Validator+"\n"), 0644)
+}
+
+// removePart removes a partial download along with its source
+func removePart(tmpPath string) {
+	os.Remove(tmpPath)
+	os.Remove(tmpPath + ".source")
+}
+
+// responseValidator returns the strong ETag of resp, or its Last-Modified
+// date. Weak ETags can't be used with If-Range.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
 	}
-	defer out.Close()
+	return resp.Header.Get("Last-Modified")
+}
 
-	resp, err := http.Get(url)
+// fetch makes a single attempt at url, appending to the partial download.
+// A partial download is only resumed from the URL it came from, and only if
+// the file there is unchanged when the server knows a validator for it.
+func (d *Download) fetch(url, tmpPath string) error {
+	var offset int64
+	if info, err := os.Stat(tmpPath); err == nil {
+		offset = info.Size()
+	}
+	source := readPartSource(tmpPath)
+	if offset > 0 && source.URL != url {
+		// Another mirror may serve a different file under the same name
+		removePart(tmpPath)
+		offset = 0
+	}
+	if d.Size > 0 && offset >= d.Size {
+		// Complete or garbage, either way the checks below decide
+		if offset == d.Size {
+			return nil
+		}
+		removePart(tmpPath)
+		offset = 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if source.Validator != "" {
+			req.Header.Set("If-Range", source.Validator)
+		}
+	}
+	client := d.Client
+	if client == nil {
+		client = DownloadClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The server ignored the range or the file changed, start over
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			removePart(tmpPath)
+			return fmt.Errorf("Could not download %s: unexpected Content-Range %q", url, resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial download doesn't fit the file, start over
+		removePart(tmpPath)
+		return fmt.Errorf("Could not resume %s: %s", url, resp.Status)
+	default:
+		return &HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	if err := writePartSource(tmpPath, partSource{URL: url, Validator: responseValidator(resp)}); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(tmpPath, flags, 0644)
 	if err != nil {
 		return err
 	}
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	} else if i := strings.LastIndex(resp.Header.Get("Content-Range"), "/"); i != -1 {
+		fmt.Sscan(resp.Header.Get("Content-Range")[i+1:], &total)
+	}
+	progress := &progressWriter{written: offset, total: total, progress: d.Progress}
+	body := &stallReader{r: resp.Body, timer: time.AfterFunc(DownloadStallTimeout, cancel)}
+	defer body.timer.Stop()
+	if _, err = io.Copy(io.MultiWriter(out, progress), body); err != nil {
+		out.Close()
+		return fmt.Errorf("Could not download %s: %s", url, err)
+	}
+	return out.Close()
+}
 
+// verify checks the downloaded file against the expected size and checksum
+func (d *Download) verify(tmpPath string) error {
+	if d.Size > 0 {
+		info, err := os.Stat(tmpPath)
+		if err != nil {
+			return err
+		}
+		if info.Size() != d.Size {
+			return fmt.Errorf("%s has size %d, expected %d", d.Path, info.Size(), d.Size)
+		}
+	}
+	if d.Checksum != "" {
+		return VerifyChecksum(tmpPath, d.Checksum, d.NewHash)
+	}
 	return nil
 }
+
+// Run downloads the file. It is written under a temporary name and renamed
+// once complete and verified, so Path never holds a partial download.
+func (d *Download) Run() error {
+	if len(d.URLs) == 0 {
+		return fmt.Errorf("No URL to download %s from", d.Path)
+	}
+	tmpPath := d.Path + ".part"
+	var err error
+	for i, url := range d.URLs {
+		backoff := d.Backoff
+		for attempt := 0; attempt <= d.Retries; attempt++ {
+			if attempt > 0 {
+				Warningf("%s, retrying in %s", err, backoff)
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+			if err = d.fetch(url, tmpPath); err == nil {
+				if err = d.verify(tmpPath); err == nil {
+					os.Remove(tmpPath + ".source")
+					return os.Rename(tmpPath, d.Path)
+				}
+				// Resuming a corrupt download won't fix it
+				removePart(tmpPath)
+			}
+			if httpErr, ok := err.(*HTTPError); ok && !httpErr.temporary() {
+				break
+			}
+		}
+		if i < len(d.URLs)-1 {
+			Warningf("%s, trying the next mirror", err)
+		}
+	}
+	return err
+}
+
+// DownloadAll runs the downloads with at most parallel of them at once.
+// Returns the first error in the order of downloads.
+func DownloadAll(downloads []*Download, parallel int) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	errs := make([]error, len(downloads))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, d := range downloads {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, d *Download) {
+			defer wg.Done()
+			errs[i] = d.Run()
+			<-sem
+		}(i, d)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request makes a request of RequestTimeout at most with the download client
+func request(method, url string) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	resp, err := DownloadClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return resp, cancel, nil
+}
+
+// Fetch returns the contents of a small file like a directory listing
+func Fetch(url string) ([]byte, error) {
+	resp, cancel, err := request("GET", url)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not download %s: %s", url, err)
+	}
+	return buf, nil
+}
+
+// URLExists reports if url can be downloaded
+func URLExists(url string) bool {
+	resp, cancel, err := request("HEAD", url)
+	if err != nil {
+		return false
+	}
+	defer cancel()
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// Validator returns the ETag of url, or its Last-Modified date if the server
+// sends no ETag. It changes when the file is replaced.
+func Validator(url string) (string, error) {
+	resp, cancel, err := request("HEAD", url)
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+	return resp.Header.Get("Last-Modified"), nil
+}
+
+// DownloadFile downloads url to filepath, retrying on failures. The file is
+// written under a temporary name and renamed once complete so filepath never
+// holds a partial download.
+func DownloadFile(filepath string, url string) error {
+	return NewDownload(filepath, url).Run()
+}
@@ -0,0 +1,277 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+var payload = []byte(strings.Repeat("archlinux-bootstrap ", 512))
+
+func payloadSum() string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+func newDownloadDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func testDownload(dst string, urls ...string) *Download {
+	d := NewDownload(dst, urls...)
+	d.Backoff = time.Millisecond
+	d.Size = int64(len(payload))
+	d.Checksum = payloadSum()
+	d.NewHash = sha256.New
+	return d
+}
+
+func checkPayload(t *testing.T, dst string) {
+	buf, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(payload) {
+		t.Errorf("downloaded %d bytes, expected %d", len(buf), len(payload))
+	}
+	if _, err := os.Stat(dst + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial download left behind")
+	}
+}
+
+func TestDownloadFailover(t *testing.T) {
+	dir, cleanup := newDownloadDir(t)
+	defer cleanup()
+
+	var broken int
+	mirror1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		broken++
+		http.Error(w, "broken", http.StatusServiceUnavailable)
+	}))
+	defer mirror1.Close()
+	var missing int
+	mirror2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		missing++
+		http.NotFound(w, r)
+	}))
+	defer mirror2.Close()
+	mirror3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer mirror3.Close()
+
+	dst := path.Join(dir, "bootstrap.tar.zst")
+	d := testDownload(dst, mirror1.URL+"/file", mirror2.URL+"/file", mirror3.URL+"/file")
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkPayload(t, dst)
+	if broken != d.Retries+1 {
+		t.Errorf("expected %d attempts on the broken mirror, got %d", d.Retries+1, broken)
+	}
+	if missing != 1 {
+		t.Errorf("expected a single attempt on the mirror without the file, got %d", missing)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	dir, cleanup := newDownloadDir(t)
+	defer cleanup()
+
+	half := len(payload) / 2
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if r.Header.Get("Range") != fmt.Sprintf("bytes=%d-", half) {
+			// Cut the connection half way through
+			w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+			w.Write(payload[:half])
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(payload)-1, len(payload)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(payload[half:])
+	}))
+	defer server.Close()
+
+	dst := path.Join(dir, "bootstrap.tar.zst")
+	var written, total int64
+	d := testDownload(dst, server.URL+"/file")
+	d.Progress = func(w, t int64) {
+		written, total = w, t
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkPayload(t, dst)
+	if len(ranges) != 2 || ranges[0] != "" {
+		t.Errorf("expected a full and a ranged request, got %q", ranges)
+	}
+	if written != int64(len(payload)) || total != int64(len(payload)) {
+		t.Errorf("progress ended at %d/%d", written, total)
+	}
+}
+
+// cutHalf sends the first half of buf and cuts the connection
+func cutHalf(w http.ResponseWriter, buf []byte) {
+	w.Header().Set("Content-Length", fmt.Sprint(len(buf)))
+	w.Write(buf[:len(buf)/2])
+}
+
+func TestDownloadMirrorChange(t *testing.T) {
+	dir, cleanup := newDownloadDir(t)
+	defer cleanup()
+
+	other := []byte(strings.Repeat("archlinux-bootstrap-", 512))
+	mirror1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"other"`)
+		cutHalf(w, other)
+	}))
+	defer mirror1.Close()
+	var ranges []string
+	mirror2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"payload"`)
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(string(payload)))
+	}))
+	defer mirror2.Close()
+
+	dst := path.Join(dir, "bootstrap.tar.zst")
+	d := testDownload(dst, mirror1.URL+"/file", mirror2.URL+"/file")
+	d.Retries = 0
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkPayload(t, dst)
+	if len(ranges) != 1 || ranges[0] != "" {
+		t.Errorf("expected the second mirror to serve the whole file, got ranges %q", ranges)
+	}
+	if _, err := os.Stat(dst + ".part.source"); !os.IsNotExist(err) {
+		t.Errorf("source of the partial download left behind")
+	}
+}
+
+func TestDownloadReplaced(t *testing.T) {
+	dir, cleanup := newDownloadDir(t)
+	defer cleanup()
+
+	old := []byte(strings.Repeat("archlinux-bootstrap-", 512))
+	var ifRanges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(ifRanges) == 0 && r.Header.Get("Range") == "" {
+			ifRanges = append(ifRanges, "")
+			w.Header().Set("ETag", `"old"`)
+			cutHalf(w, old)
+			return
+		}
+		// The file was replaced in the meantime
+		ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+		w.Header().Set("ETag", `"new"`)
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(string(payload)))
+	}))
+	defer server.Close()
+
+	dst := path.Join(dir, "bootstrap.tar.zst")
+	d := testDownload(dst, server.URL+"/file")
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkPayload(t, dst)
+	if len(ifRanges) != 2 || ifRanges[1] != `"old"` {
+		t.Errorf("expected the resume to send If-Range \"old\", got %q", ifRanges)
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	dir, cleanup := newDownloadDir(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		corrupt := append([]byte{}, payload...)
+		corrupt[0] = 'A'
+		w.Write(corrupt)
+	}))
+	defer server.Close()
+
+	dst := path.Join(dir, "bootstrap.tar.zst")
+	err := testDownload(dst, server.URL+"/file").Run()
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("corrupt download was kept")
+	}
+}
+
+func TestDownloadStalled(t *testing.T) {
+	dir, cleanup := newDownloadDir(t)
+	defer cleanup()
+	defer func(timeout time.Duration) { DownloadStallTimeout = timeout }(DownloadStallTimeout)
+	DownloadStallTimeout = 50 * time.Millisecond
+
+	done := make(chan struct{})
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+		w.Write(payload[:10])
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer mirror.Close()
+	defer close(done)
+
+	d := testDownload(path.Join(dir, "bootstrap.tar.zst"), mirror.URL+"/file")
+	d.Retries = 0
+	start := time.Now()
+	if err := d.Run(); err == nil {
+		t.Error("expected an error for a stalled download")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("stalled download took %s", elapsed)
+	}
+}
+
+func TestDownloadAll(t *testing.T) {
+	dir, cleanup := newDownloadDir(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(payload)
+	}))
+	defer server.Close()
+
+	var downloads []*Download
+	for i := 0; i < 5; i++ {
+		downloads = append(downloads, testDownload(path.Join(dir, fmt.Sprint(i)), server.URL+"/file"))
+	}
+	if err := DownloadAll(downloads, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range downloads {
+		checkPayload(t, d.Path)
+	}
+
+	downloads = append(downloads, testDownload(path.Join(dir, "missing"), server.URL+"/missing"))
+	err := DownloadAll(downloads, 2)
+	if httpErr, ok := err.(*HTTPError); !ok || httpErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a 404, got %v", err)
+	}
+}
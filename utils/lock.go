@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// FileLock is a flock(2) on a lock file
+type FileLock struct {
+	file *os.File
+}
+
+func openLock(filename string) (*FileLock, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the lock %s: %s", filename, err)
+	}
+	return &FileLock{file: f}, nil
+}
+
+// LockFile locks filename exclusively, waiting for other holders. The wait is
+// announced with name, what the lock protects.
+func LockFile(filename, name string) (*FileLock, error) {
+	l, err := openLock(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.flock(syscall.LOCK_EX | syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		Msg2f("Waiting for the lock on %s", name)
+		err = l.flock(syscall.LOCK_EX)
+	}
+	if err != nil {
+		l.file.Close()
+		return nil, fmt.Errorf("Could not lock %s: %s", name, err)
+	}
+	return l, nil
+}
+
+// TryLockFile locks filename exclusively if nobody else holds it
+func TryLockFile(filename string) (*FileLock, error) {
+	l, err := openLock(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.flock(syscall.LOCK_EX | syscall.LOCK_NB); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *FileLock) flock(how int) error {
+	for {
+		err := syscall.Flock(int(l.file.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// Share turns the lock into a shared one
+func (l *FileLock) Share() error {
+	return l.flock(syscall.LOCK_SH)
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	defer l.file.Close()
+	return l.flock(syscall.LOCK_UN)
+}
@@ -2,7 +2,9 @@ package utils
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	alpm "github.com/Jguer/go-alpm"
 )
@@ -20,3 +22,103 @@ func GetPacmanConf(path string) (alpm.PacmanConfig, error) {
 	}
 	return pacmanconf, nil
 }
+
+// Mirrors returns the root of every Server of a repository in pacman.conf,
+// in order. For a Server of https://mirror/$repo/os/$arch it is
+// https://mirror/.
+func Mirrors(conf alpm.PacmanConfig, repo string) []string {
+	var mirrors []string
+	for _, v := range conf.Repos {
+		if v.Name != repo {
+			continue
+		}
+		for _, server := range v.Servers {
+			s := strings.Split(server, "$repo")
+			mirrors = append(mirrors, s[0])
+		}
+	}
+	return mirrors
+}
+
+// isArchitectureLine reports if a pacman.conf line sets Architecture, also
+// commented like "# Architecture = auto"
+func isArchitectureLine(line string) bool {
+	key := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+	return strings.TrimSpace(strings.SplitN(key, "=", 2)[0]) == "Architecture"
+}
+
+// PacmanConfArchitecture returns the first architecture of the Architecture
+// option of a pacman.conf. A missing option or "auto" returns an empty string.
+func PacmanConfArchitecture(conf string) string {
+	var section string
+	for _, line := range strings.Split(conf, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = line
+		}
+		if section != "[options]" || strings.HasPrefix(line, "#") || !isArchitectureLine(line) {
+			continue
+		}
+		values := strings.SplitN(line, "=", 2)
+		if len(values) != 2 {
+			return ""
+		}
+		if fields := strings.Fields(values[1]); len(fields) > 0 && fields[0] != "auto" {
+			return fields[0]
+		}
+		return ""
+	}
+	return ""
+}
+
+// SetPacmanConfArchitecture sets the Architecture option of a pacman.conf.
+// The first Architecture line of [options] is replaced, commented or not.
+func SetPacmanConfArchitecture(conf, arch string) string {
+	setting := "Architecture = " + arch
+	var lines []string
+	var section string
+	var done bool
+	for _, line := range strings.Split(conf, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			section = trimmed
+		}
+		if section == "[options]" && isArchitectureLine(trimmed) {
+			if !done {
+				line = setting
+				done = true
+			} else if !strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+		}
+		lines = append(lines, line)
+	}
+	if !done {
+		for i, line := range lines {
+			if strings.TrimSpace(line) == "[options]" {
+				lines = append(lines[:i+1], append([]string{setting}, lines[i+1:]...)...)
+				break
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ArchitecturePacmanConf writes a copy of the pacman.conf with Architecture
+// set to arch to a temporary file, which the caller removes
+func ArchitecturePacmanConf(PacmanConf, arch string) (string, error) {
+	buf, err := ioutil.ReadFile(PacmanConf)
+	if err != nil {
+		return "", fmt.Errorf("Couldnt read pacman.conf from %s", PacmanConf)
+	}
+	f, err := ioutil.TempFile("", "pacman.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(SetPacmanConfArchitecture(string(buf), arch)); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestArchitecturePacmanConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacmanconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := path.Join(dir, "pacman.conf")
+	if err := ioutil.WriteFile(source, []byte("[options]\nArchitecture = auto\n\n[core]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ArchitecturePacmanConf(source, "i686")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(conf)
+	buf, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[options]\nArchitecture = i686\n\n[core]\n"; string(buf) != expected {
+		t.Errorf("unexpected pacman.conf:\n%s", buf)
+	}
+	if arch := PacmanConfArchitecture(string(buf)); arch != "i686" {
+		t.Errorf("expected i686, got %q", arch)
+	}
+	buf, err = ioutil.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if PacmanConfArchitecture(string(buf)) != "" {
+		t.Error("the source pacman.conf was changed")
+	}
+}
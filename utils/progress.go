@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ProgressInterval is how often progress is printed when Stdout is not a
+	// terminal
+	ProgressInterval = 10 * time.Second
+	// How often the bar is redrawn on terminals
+	progressRedraw = 200 * time.Millisecond
+	progressWidth  = 30
+
+	// NoProgressBar prints progress as lines even on terminals
+	NoProgressBar = false
+)
+
+// Clears the rest of the line when the bar is redrawn shorter
+const clearLine = "\x1b[K"
+
+// isTerminal reports if w is a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// FormatBytes returns n in human readable binary units, e.g. 1.5 MiB
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d >= time.Hour {
+		return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// Progress reports how far along an operation is. On terminals it is drawn
+// as a bar, otherwise a line is printed every ProgressInterval.
+type Progress struct {
+	Name string
+	// Total is the size of the operation, unknown if less than 1
+	Total int64
+	// Unit names what is counted, e.g. "files". Bytes if empty.
+	Unit string
+
+	mu      sync.Mutex
+	current int64
+	initial int64
+	started time.Time
+	printed time.Time
+	tty     bool
+	done    bool
+}
+
+// NewProgress starts reporting progress of an operation of total bytes
+func NewProgress(name string, total int64) *Progress {
+	now := time.Now()
+	return &Progress{
+		Name:    name,
+		Total:   total,
+		started: now,
+		printed: now,
+		tty:     isTerminal(Stdout) && !NoProgressBar,
+	}
+}
+
+// Add counts n more
+func (p *Progress) Add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current += n
+	p.update()
+}
+
+// Set updates the current and total count, the signature fits
+// Download.Progress. The first count is taken as already done before we
+// started, e.g. a resumed download, and not part of the rate.
+func (p *Progress) Set(current, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == 0 && p.initial == 0 {
+		p.initial = current
+	}
+	p.current, p.Total = current, total
+	p.update()
+}
+
+// Write counts the bytes written, so Progress can be used with
+// io.MultiWriter
+func (p *Progress) Write(b []byte) (int, error) {
+	p.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// Reader returns a reader counting what is read from r
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, p)
+}
+
+// Done prints the final state
+func (p *Progress) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.done = true
+	if p.tty {
+		fmt.Fprintf(Stdout, "\r%s%s\n", p.bar(), clearLine)
+		return
+	}
+	Msg2f("%s", p.line())
+}
+
+func (p *Progress) update() {
+	if p.done {
+		return
+	}
+	interval := ProgressInterval
+	if p.tty {
+		interval = progressRedraw
+	}
+	now := time.Now()
+	if now.Sub(p.printed) < interval {
+		return
+	}
+	p.printed = now
+	if p.tty {
+		fmt.Fprintf(Stdout, "\r%s%s", p.bar(), clearLine)
+		return
+	}
+	Msg2f("%s", p.line())
+}
+
+func (p *Progress) format(n int64) string {
+	if p.Unit == "" {
+		return FormatBytes(n)
+	}
+	return fmt.Sprintf("%d %s", n, p.Unit)
+}
+
+// rate returns the count per second
+func (p *Progress) rate() float64 {
+	elapsed := time.Since(p.started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.current-p.initial) / elapsed
+}
+
+// stats returns the amount done, rate and remaining time
+func (p *Progress) stats() []string {
+	amount := p.format(p.current)
+	if p.Total > 0 {
+		amount += "/" + p.format(p.Total)
+	}
+	stats := []string{amount}
+	rate := p.rate()
+	if rate <= 0 {
+		return stats
+	}
+	stats = append(stats, p.format(int64(rate))+"/s")
+	if p.Total > 0 && !p.done {
+		eta := time.Duration(float64(p.Total-p.current) / rate * float64(time.Second))
+		stats = append(stats, "ETA "+formatDuration(eta))
+	}
+	return stats
+}
+
+func (p *Progress) percent() int {
+	if p.Total <= 0 {
+		return -1
+	}
+	percent := int(p.current * 100 / p.Total)
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+func (p *Progress) bar() string {
+	var bar string
+	if percent := p.percent(); percent >= 0 {
+		filled := progressWidth * percent / 100
+		bar = fmt.Sprintf(" [%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat("-", progressWidth-filled), percent)
+	}
+	return fmt.Sprintf("%s %s%s  %s", blue("  ->"), bold(p.Name), bar, strings.Join(p.stats(), "  "))
+}
+
+func (p *Progress) line() string {
+	line := p.Name + ":"
+	if percent := p.percent(); percent >= 0 {
+		line += fmt.Sprintf(" %d%%", percent)
+	}
+	return line + " (" + strings.Join(p.stats(), ", ") + ")"
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{
+		0:                 "0 B",
+		1023:              "1023 B",
+		1024:              "1.0 KiB",
+		1536:              "1.5 KiB",
+		800 * 1024 * 1024: "800.0 MiB",
+		3 << 40:           "3.0 TiB",
+	} {
+		if actual := FormatBytes(n); actual != expected {
+			t.Errorf("FormatBytes(%d) = %q, expected %q", n, actual, expected)
+		}
+	}
+}
+
+func TestProgressLines(t *testing.T) {
+	var buf bytes.Buffer
+	Stdout = &buf
+	UseColors(false)
+	defer resetOutput()
+	interval := ProgressInterval
+	ProgressInterval = 0
+	defer func() { ProgressInterval = interval }()
+
+	p := NewProgress("archlinux-bootstrap.tar.zst", 4096)
+	p.Write(make([]byte, 1024))
+	p.Write(make([]byte, 1024))
+	p.Done()
+	// Nothing is printed after Done
+	p.Write(make([]byte, 2048))
+
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", lines)
+	}
+	for i, percent := range []string{"25%", "50%", "50%"} {
+		prefix := "  -> archlinux-bootstrap.tar.zst: " + percent + " ("
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("expected %q to start with %q", lines[i], prefix)
+		}
+	}
+	if !strings.Contains(lines[1], "2.0 KiB/4.0 KiB") {
+		t.Errorf("expected the byte counts in %q", lines[1])
+	}
+}
+
+func TestProgressUnknownTotal(t *testing.T) {
+	var buf bytes.Buffer
+	Stdout = &buf
+	UseColors(false)
+	defer resetOutput()
+
+	p := NewProgress("Copying /var/lib/root", -1)
+	p.Unit = "files"
+	for i := 0; i < 42; i++ {
+		p.Add(1)
+	}
+	p.Done()
+	if !strings.HasPrefix(buf.String(), "  -> Copying /var/lib/root: (42 files") {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+}
@@ -2,21 +2,163 @@ package utils
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
 )
 
-// TODO: Disalikes .iso. Wrong header
-func UntarGo(tarball, target string) error {
-	reader, err := os.Open(tarball)
+// xattrs are stored as PAX records with this prefix
+const paxXattr = "SCHILY.xattr."
+
+// DecompressReader returns a reader decompressing gzip, zstd or xz streams
+// depending on their magic bytes. Anything else is returned as is.
+func DecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(xzMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		x, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(x), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// CompressWriter returns a writer compressing with gzip, zstd or xz depending
+// on the extension of filename, e.g. .tar.gz. Closing it does not close w.
+func CompressWriter(w io.Writer, filename string) (io.WriteCloser, error) {
+	switch filepath.Ext(filename) {
+	case ".gz":
+		return gzip.NewWriter(w), nil
+	case ".zst":
+		return zstd.NewWriter(w)
+	case ".xz":
+		return xz.NewWriter(w)
+	case ".tar":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("Unsupported compression of %s", filename)
+}
+
+// ExtractError is returned for archive entries we refuse to extract
+type ExtractError struct {
+	Name   string
+	Reason string
+}
+
+func (e *ExtractError) Error() string {
+	return fmt.Sprintf("Refusing to extract %s: %s", e.Name, e.Reason)
+}
+
+// escapes reports if a relative entry name points outside of the archive root
+func escapes(name string) bool {
+	name = filepath.Clean(strings.TrimLeft(name, "/"))
+	return name == ".." || strings.HasPrefix(name, "../")
+}
+
+// stripPath removes the leading components of an entry name. Returns false if
+// nothing remains.
+func stripPath(name string, components int) (string, bool) {
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if components == 0 {
+		return name, name != ""
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) <= components {
+		return "", false
+	}
+	return filepath.Join(parts[components:]...), true
+}
+
+// securePath joins name to target and makes sure no parent directory of the
+// result is a symlink, so entries can't be written outside of target.
+func securePath(target, name string) (string, error) {
+	dst := filepath.Join(target, name)
+	if dst != target && !strings.HasPrefix(dst, target+string(os.PathSeparator)) {
+		return "", &ExtractError{Name: name, Reason: "path escapes the target directory"}
+	}
+	dir := target
+	parts := strings.Split(name, string(os.PathSeparator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", &ExtractError{Name: name, Reason: "parent directory is a symlink"}
+		}
+	}
+	return dst, nil
+}
+
+// Extract unpacks a gzip, zstd or xz compressed, or uncompressed, tarball into
+// target, removing stripComponents leading path components from every entry.
+// Ownership, permissions, modification times and extended attributes are
+// preserved. Entries escaping target are rejected.
+func Extract(tarball, target string, stripComponents int) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	progress := NewProgress("Extracting "+filepath.Base(tarball), info.Size())
+	defer progress.Done()
+	return ExtractReader(progress.Reader(f), target, stripComponents)
+}
+
+// ExtractReader is Extract for a stream
+func ExtractReader(r io.Reader, target string, stripComponents int) error {
+	e, err := NewExtractor(target, stripComponents)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
-	tarReader := tar.NewReader(reader)
+	stream, err := DecompressReader(r)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
 
+	tarReader := tar.NewReader(stream)
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
@@ -24,35 +166,185 @@ func UntarGo(tarball, target string) error {
 		} else if err != nil {
 			return err
 		}
-		path := filepath.Join(target, header.Name)
-		info := header.FileInfo()
-		if info.IsDir() {
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return err
+		if _, err := e.Entry(header, tarReader); err != nil {
+			return err
+		}
+	}
+	return e.Finish()
+}
+
+// Extractor writes tar entries below Target. Finish has to be called once all
+// entries are written.
+type Extractor struct {
+	Target          string
+	StripComponents int
+
+	// Directory times change while we fill them, so they are set last
+	dirs  []dirTime
+	owner bool
+}
+
+type dirTime struct {
+	path  string
+	mtime time.Time
+}
+
+func NewExtractor(target string, stripComponents int) (*Extractor, error) {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	return &Extractor{
+		Target:          target,
+		StripComponents: stripComponents,
+		owner:           os.Geteuid() == 0,
+	}, nil
+}
+
+// Path returns where an entry name is extracted to, or false if it is
+// stripped. Entries escaping Target are rejected.
+func (e *Extractor) Path(name string) (string, bool, error) {
+	if escapes(name) {
+		return "", false, &ExtractError{Name: name, Reason: "path escapes the target directory"}
+	}
+	stripped, ok := stripPath(name, e.StripComponents)
+	if !ok {
+		return "", false, nil
+	}
+	dst, err := securePath(e.Target, stripped)
+	if err != nil {
+		return "", false, err
+	}
+	return dst, true, nil
+}
+
+// Entry writes a single entry, with its contents read from r. Returns the
+// path written to, which is empty for stripped and skipped entries.
+func (e *Extractor) Entry(header *tar.Header, r io.Reader) (string, error) {
+	dst, ok, err := e.Path(header.Name)
+	if err != nil || !ok {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	mode := header.FileInfo().Mode()
+
+	// Entries replace whatever was there, unless both are directories
+	if info, err := os.Lstat(dst); err == nil {
+		if header.Typeflag == tar.TypeDir && info.Mode()&os.ModeSymlink != 0 {
+			return "", &ExtractError{Name: header.Name, Reason: "directory is a symlink"}
+		}
+		if info.IsDir() != (header.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(dst); err != nil {
+				return "", err
 			}
-			continue
 		}
+	}
 
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
-		if err != nil {
-			return err
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return "", err
+		}
+	case tar.TypeReg:
+		if err := writeFile(dst, r, mode.Perm()); err != nil {
+			return "", err
+		}
+	case tar.TypeSymlink:
+		os.Remove(dst)
+		if err := os.Symlink(header.Linkname, dst); err != nil {
+			return "", err
 		}
-		defer file.Close()
-		_, err = io.Copy(file, tarReader)
+	case tar.TypeLink:
+		src, ok, err := e.Path(header.Linkname)
 		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", &ExtractError{Name: header.Name, Reason: "hardlink target is stripped"}
+		}
+		os.Remove(dst)
+		if err := os.Link(src, dst); err != nil {
+			return "", err
+		}
+		// Metadata is shared with the target
+		return dst, nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(mode.Perm())
+		switch header.Typeflag {
+		case tar.TypeChar:
+			devMode |= unix.S_IFCHR
+		case tar.TypeBlock:
+			devMode |= unix.S_IFBLK
+		case tar.TypeFifo:
+			devMode |= unix.S_IFIFO
+		}
+		os.Remove(dst)
+		dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+		if err := unix.Mknod(dst, devMode, int(dev)); err != nil {
+			return "", err
+		}
+	default:
+		Warningf("Skipping %s: unsupported tar entry type %c", header.Name, header.Typeflag)
+		return "", nil
+	}
+
+	if e.owner {
+		if err := os.Lchown(dst, header.Uid, header.Gid); err != nil {
+			return "", err
+		}
+	}
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxXattr) {
+			continue
+		}
+		if err := unix.Lsetxattr(dst, strings.TrimPrefix(key, paxXattr), []byte(value), 0); err != nil {
+			return "", fmt.Errorf("Could not set xattrs on %s: %s", dst, err)
+		}
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		mtime := unix.NsecToTimeval(header.ModTime.UnixNano())
+		unix.Lutimes(dst, []unix.Timeval{mtime, mtime})
+		return dst, nil
+	}
+	// chown clears setuid and setgid, so the mode is applied afterwards
+	if err := os.Chmod(dst, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return "", err
+	}
+	if header.Typeflag == tar.TypeDir {
+		e.dirs = append(e.dirs, dirTime{dst, header.ModTime})
+		return dst, nil
+	}
+	return dst, os.Chtimes(dst, header.ModTime, header.ModTime)
+}
+
+// Finish sets the modification times of the extracted directories
+func (e *Extractor) Finish() error {
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		// Directories might have been removed since, e.g. by OCI whiteouts
+		err := os.Chtimes(e.dirs[i].path, e.dirs[i].mtime, e.dirs[i].mtime)
+		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
+	e.dirs = nil
 	return nil
 }
 
-func Untar(tarball, target string) error {
-	var cmd *exec.Cmd
-	cmd = exec.Command("/usr/bin/tar", "xvf", tarball, "-C", target, "--strip-components=1")
-	// cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-	err := cmd.Run()
+func writeFile(dst string, r io.Reader, mode os.FileMode) error {
+	// Replace instead of writing through whatever is there, e.g. a symlink
+	os.Remove(dst)
+	file, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
 	if err != nil {
 		return err
 	}
-	return nil
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
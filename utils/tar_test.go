@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var mtime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func writeTar(t *testing.T, w io.Writer, headers []*tar.Header) {
+	tw := tar.NewWriter(w)
+	for _, hdr := range headers {
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = mtime
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(hdr.Name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func bootstrapHeaders() []*tar.Header {
+	return []*tar.Header{
+		{Name: "root.x86_64/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "root.x86_64/usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "root.x86_64/usr/bin/bash", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "root.x86_64/usr/bin/sh", Typeflag: tar.TypeLink, Linkname: "root.x86_64/usr/bin/bash"},
+		{Name: "root.x86_64/bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"},
+		{Name: "root.x86_64/etc/shadow", Typeflag: tar.TypeReg, Mode: 0600},
+	}
+}
+
+func checkBootstrap(t *testing.T, dir string) {
+	info, err := os.Stat(path.Join(dir, "usr/bin/bash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 || !info.ModTime().Equal(mtime) {
+		t.Errorf("unexpected mode %s or mtime %s", info.Mode(), info.ModTime())
+	}
+	if info, err := os.Stat(path.Join(dir, "etc/shadow")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("etc/shadow was not extracted with its mode: %v", err)
+	}
+	if link, err := os.Readlink(path.Join(dir, "bin")); err != nil || link != "usr/bin" {
+		t.Errorf("bin is not a symlink to usr/bin: %v", err)
+	}
+	sh, err := os.Stat(path.Join(dir, "usr/bin/sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(info, sh) {
+		t.Error("usr/bin/sh is not a hardlink to usr/bin/bash")
+	}
+	if info, err := os.Stat(path.Join(dir, "usr/bin")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("directory mtime was not preserved: %v", err)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	compressors := map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			z, _ := zstd.NewWriter(w)
+			return z
+		},
+		"xz": func(w io.Writer) io.WriteCloser {
+			x, _ := xz.NewWriter(w)
+			return x
+		},
+	}
+	for name, compressor := range compressors {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "extract")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			var buf bytes.Buffer
+			w := compressor(&buf)
+			writeTar(t, w, bootstrapHeaders())
+			w.Close()
+			if err := ExtractReader(&buf, dir, 1); err != nil {
+				t.Fatal(err)
+			}
+			checkBootstrap(t, dir)
+		})
+	}
+}
+
+func TestExtractEscape(t *testing.T) {
+	archives := map[string][]*tar.Header{
+		"dotdot": {
+			{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"symlink": {
+			{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/tmp"},
+			{Name: "etc/escaped", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"hardlink": {
+			{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"},
+		},
+	}
+	for name, headers := range archives {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "extract")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			target := path.Join(dir, "root")
+			var buf bytes.Buffer
+			writeTar(t, &buf, headers)
+			err = ExtractReader(&buf, target, 0)
+			if _, ok := err.(*ExtractError); !ok {
+				t.Errorf("expected the archive to be rejected, got %v", err)
+			}
+			if _, err := os.Stat(path.Join(dir, "escaped")); err == nil {
+				t.Error("file was written outside of the target")
+			}
+		})
+	}
+}